@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+func (s *H2SProxyServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.handler())
+	mux.HandleFunc("POST /reload", s.reloadHandler)
+	mux.HandleFunc("GET /match", s.matchHandler)
+	mux.HandleFunc("GET /config", s.configHandler)
+	mux.HandleFunc("GET /status", s.statusHandler)
+	mux.HandleFunc("GET /connections", s.connectionsHandler)
+	mux.HandleFunc("POST /connections/{id}/cancel", s.cancelHandler)
+	mux.HandleFunc("GET /maintenance", s.maintenanceHandler)
+	mux.HandleFunc("POST /maintenance", s.enterMaintenanceHandler)
+	mux.HandleFunc("DELETE /maintenance", s.exitMaintenanceHandler)
+	return s.adminAuth(mux)
+}
+
+// adminAuth checks the bearer token against the current profile, so a reload can rotate it.
+func (s *H2SProxyServer) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		token := s.profile.Load().Admin.Token
+		if token != "" {
+			got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				wr.Header().Set("WWW-Authenticate", `Bearer realm="h2s-proxy admin"`)
+				http.Error(wr, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(wr, req)
+	})
+}
+
+func (s *H2SProxyServer) reloadHandler(wr http.ResponseWriter, req *http.Request) {
+	profile, err := s.reload()
+	if err != nil {
+		s.logger.Errorf("failed to reload profile: %v", err)
+		writeJSON(wr, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(wr, http.StatusOK, map[string]int{"rules": len(profile.Rules)})
+}
+
+// configHandler returns the profile in effect, after defaults and any reload, with credentials redacted.
+func (s *H2SProxyServer) configHandler(wr http.ResponseWriter, req *http.Request) {
+	writeJSON(wr, http.StatusOK, s.profile.Load())
+}
+
+func writeJSON(wr http.ResponseWriter, status int, v any) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+	json.NewEncoder(wr).Encode(v)
+}
+
+// matchResult describes how the proxy would route a request.
+type matchResult struct {
+	Decision  string   `json:"decision"` // socks5, direct or deny
+	Rule      string   `json:"rule"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Reason    string   `json:"reason,omitempty"`  // why the request would be denied
+	Address   string   `json:"address,omitempty"` // the private address refused by block_private_networks
+	Skipped   []string `json:"skipped,omitempty"` // matching rules passed over because their circuit is open
+	Endpoints []string `json:"endpoints,omitempty"`
+	Resolved  []string `json:"resolved,omitempty"` // addresses of a hostname matched with resolve_hostnames
+}
+
+// matchHandler runs the matcher for a sample request given as query parameters, without sending anything upstream.
+func (s *H2SProxyServer) matchHandler(wr http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	host, port, method := q.Get("host"), q.Get("port"), q.Get("method")
+	if host == "" {
+		writeJSON(wr, http.StatusBadRequest, map[string]string{"error": "host is required"})
+		return
+	}
+	if method == "" {
+		method = http.MethodGet
+	}
+	profile := s.profile.Load()
+	header := http.Header{}
+	if ct := q.Get("content_type"); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+	target := domain.Target{Host: host, Port: portNumber(port), Header: header, ServerName: q.Get("server_name"), User: q.Get("user"), Time: s.clock.Now()}
+	if at := q.Get("at"); at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			writeJSON(wr, http.StatusBadRequest, map[string]string{"error": "at must be an RFC 3339 time"})
+			return
+		}
+		target.Time = t
+	}
+	for _, c := range q["claim"] {
+		// name:value, as a token would carry after verification
+		if name, value, ok := strings.Cut(c, ":"); ok {
+			if target.Claims == nil {
+				target.Claims = map[string][]string{}
+			}
+			target.Claims[name] = append(target.Claims[name], value)
+		}
+	}
+
+	res := matchResult{Decision: domain.ProxyTypeDeny, Rule: ruleLabelNone}
+	switch {
+	case !profile.AllowsMethod(method):
+		res.Reason = "method not allowed"
+	case profile.PortBlocked(port):
+		res.Reason = "blocked port"
+	case method == http.MethodConnect && !profile.ConnectPortAllowed(port):
+		res.Reason = "CONNECT port not allowed"
+	default:
+		var rule *domain.Rule
+		matched := s.matchRules(req.Context(), profile, &target)
+		for _, ip := range target.IPs {
+			res.Resolved = append(res.Resolved, ip.String())
+		}
+		if len(matched) > 0 {
+			var err error
+			if rule, err = s.pickHealthy(req.Context(), profile, matched, false); err != nil {
+				res.Rule = matched[0].Name
+				res.Reason = "no healthy rule"
+				break
+			}
+			for _, m := range matched {
+				if m.Name == rule.Name {
+					break
+				}
+				res.Skipped = append(res.Skipped, m.Name)
+			}
+		}
+		res.Rule = routeName(rule)
+		if rule != nil {
+			res.Pattern = rule.MatchingPattern(target)
+		}
+		if res.Reason = denyReason(profile, rule); res.Reason != "" {
+			break
+		}
+		if res.Address, res.Reason = s.privateDestination(req.Context(), profile, rule, &target); res.Reason != "" {
+			break
+		}
+		if s.maintenance.covers(res.Rule) {
+			res.Reason = "maintenance"
+			break
+		}
+		res.Decision = domain.ProxyTypeDirect
+		if rule != nil {
+			res.Decision = rule.ProxyType
+			for _, ep := range rule.Endpoints {
+				res.Endpoints = append(res.Endpoints, ep.Addr())
+			}
+		}
+	}
+	writeJSON(wr, http.StatusOK, res)
+}
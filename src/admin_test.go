@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	secrets := []string{"socks-default-pw", "socks-rule-pw", "alice-pw", "bob-pw", "admin-token-1", "jwt-hmac-key-2", "api-key-3", "rule-token-4"}
+	s := newTestServer(t, `{
+  "version": 2,
+  "listen_addrs": ["127.0.0.1:0"],
+  "admin": {"addr": "127.0.0.1:0", "token": "admin-token-1"},
+  "username": "proxy", "password": "socks-default-pw",
+  "proxy_auth": {"users": {"alice": "alice-pw", "bob": "bob-pw"}},
+  "jwt": {"hmac_key": "jwt-hmac-key-2"},
+  "set_headers": {"X-Api-Key": "api-key-3"},
+  "rules": [
+    {"name": "corp", "patterns": ["10.0.0.0/8"], "proxy_ip": "192.0.2.1", "port": "1080", "username": "corp", "password": "socks-rule-pw",
+     "set_headers": {"X-Rule-Token": "rule-token-4"}}
+  ]
+}`)
+	admin := httptest.NewServer(s.adminHandler())
+	defer admin.Close()
+	get := func(token string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, admin.URL+"/config", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := admin.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	if status, _ := get(""); status != http.StatusUnauthorized {
+		t.Errorf("without the admin token: got %v, want 401", status)
+	}
+	status, body := get("admin-token-1")
+	if status != http.StatusOK {
+		t.Fatalf("got %v %s, want 200", status, body)
+	}
+	for _, secret := range secrets {
+		if strings.Contains(body, secret) {
+			t.Errorf("GET /config exposes %q", secret)
+		}
+	}
+	var config struct {
+		Password  string `json:"password"`
+		Admin     struct{ Token string }
+		ProxyAuth struct{ Users map[string]string } `json:"proxy_auth"`
+		JWT       struct {
+			HMACKey string `json:"hmac_key"`
+		}
+		SetHeaders map[string]string `json:"set_headers"`
+		Rules      []struct {
+			Name       string
+			Username   string
+			Password   string
+			SetHeaders map[string]string `json:"set_headers"`
+		}
+	}
+	if err := json.Unmarshal([]byte(body), &config); err != nil {
+		t.Fatal(err)
+	}
+	// the secrets are still reported as set
+	for name, v := range map[string]string{
+		"password":                          config.Password,
+		"admin.token":                       config.Admin.Token,
+		"proxy_auth.users.alice":            config.ProxyAuth.Users["alice"],
+		"jwt.hmac_key":                      config.JWT.HMACKey,
+		"set_headers.X-Api-Key":             config.SetHeaders["X-Api-Key"],
+		"rules[0].password":                 config.Rules[0].Password,
+		"rules[0].set_headers.X-Rule-Token": config.Rules[0].SetHeaders["X-Rule-Token"],
+	} {
+		if v != "REDACTED" {
+			t.Errorf("%v = %q, want REDACTED", name, v)
+		}
+	}
+	if config.Rules[0].Username != "corp" {
+		t.Errorf("rules[0].username = %q, want it shown as corp", config.Rules[0].Username)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	s := newTestServer(t, `{
+  "version": 2,
+  "listen_addrs": ["127.0.0.1:0"],
+  "block_private_networks": true,
+  "rules": [
+    {"name": "lab", "patterns": ["10.9.0.0/16"], "proxy_ip": "192.0.2.1", "port": "1080", "allow_private_networks": true},
+    {"name": "corp", "patterns": ["10.0.0.0/8"], "proxy_ip": "192.0.2.2", "port": "1080"}
+  ]
+}`)
+	admin := httptest.NewServer(s.adminHandler())
+	defer admin.Close()
+	match := func(host string) matchResult {
+		t.Helper()
+		res, err := admin.Client().Get(admin.URL + "/match?port=443&host=" + url.QueryEscape(host))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var got matchResult
+		if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	tests := []struct {
+		host string
+		want matchResult
+	}{
+		{"192.0.2.9", matchResult{Decision: "direct", Rule: "default"}},
+		{"10.9.1.1", matchResult{Decision: "socks5", Rule: "lab", Pattern: "10.9.0.0/16", Endpoints: []string{"192.0.2.1:1080"}}},
+		{"10.1.2.3", matchResult{Decision: "deny", Rule: "corp", Pattern: "10.0.0.0/8", Reason: "private network destination", Address: "10.1.2.3"}},
+		{"::1", matchResult{Decision: "deny", Rule: "default", Reason: "private network destination", Address: "::1"}},
+	}
+	for _, tt := range tests {
+		if got := match(tt.host); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %+v, want %+v", tt.host, got, tt.want)
+		}
+	}
+
+	s.maintenance.set("admin", maintenanceScope{Rules: []string{"lab"}})
+	want := matchResult{Decision: "deny", Rule: "lab", Pattern: "10.9.0.0/16", Reason: "maintenance"}
+	if got := match("10.9.1.1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("lab in maintenance: got %+v, want %+v", got, want)
+	}
+	if got := match("192.0.2.9"); got.Decision != "direct" {
+		t.Errorf("default route outside the maintenance scope: got %+v, want direct", got)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time        time.Time `json:"time"` // when the request arrived
+	Client      string    `json:"client"`
+	User        string    `json:"user,omitempty"`
+	Method      string    `json:"method"`
+	Destination string    `json:"destination"`
+	Rule        string    `json:"rule"`
+	Status      int       `json:"status"`
+	BytesIn     int64     `json:"bytes_in"`  // request body, or client to destination for tunnels
+	BytesOut    int64     `json:"bytes_out"` // response body, or destination to client for tunnels
+	Duration    float64   `json:"duration_seconds"`
+}
+
+// auditLog appends records to a file, rotating it by size.
+type auditLog struct {
+	cfg     domain.AuditLog
+	metrics *metrics
+	mu      sync.Mutex
+	closed  bool // records of tunnels outliving shutdown are dropped once set
+	file    *os.File
+	size    int64
+}
+
+func openAuditLog(cfg domain.AuditLog, m *metrics) (*auditLog, error) {
+	l := &auditLog{cfg: cfg, metrics: m}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// write appends one JSON record, without its newline. Records written after Close are dropped.
+func (l *auditLog) write(rec []byte) error {
+	line := append(rec[:len(rec):len(rec)], '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		l.metrics.auditDropped.inc()
+		return nil
+	}
+	if l.file == nil {
+		// a previous rotation failed to reopen the file
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.cfg.MaxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotate: %w", err)
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, moves the current file to path.1 and starts a new one.
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	path := l.cfg.Path
+	if l.cfg.MaxFiles == 0 {
+		os.Remove(path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", path, l.cfg.MaxFiles))
+		for i := l.cfg.MaxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		}
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	return l.open()
+}
+
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// auditRequest writes the audit record of a finished request to the audit log and syslog, when enabled.
+func (s *H2SProxyServer) auditRequest(req *http.Request, user string, inbound *inboundRequest, wr *statusRecorder) {
+	if s.audit == nil && s.syslog == nil {
+		return
+	}
+	status := wr.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if !s.sampleAudit(status) {
+		return
+	}
+	dest := req.URL.Host
+	if dest == "" {
+		dest = req.Host
+	}
+	rec := auditRecord{
+		Time:        inbound.start,
+		Client:      req.RemoteAddr,
+		User:        user,
+		Method:      req.Method,
+		Destination: dest,
+		Rule:        inbound.rule,
+		Status:      status,
+		BytesIn:     inbound.bodyBytes() + inbound.tunnelIn,
+		BytesOut:    wr.written + inbound.tunnelOut,
+		Duration:    time.Since(inbound.start).Seconds(),
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		s.logger.Errorf("failed to encode audit record: %v", err)
+		return
+	}
+	if s.syslog != nil {
+		s.syslog.send(line)
+	}
+	if s.audit == nil {
+		return
+	}
+	if err := s.audit.write(line); err != nil {
+		s.logger.Errorf("failed to write audit log: %v", err)
+	}
+}
+
+// sampleAudit reports whether the record of a request answered with status is kept under audit_log.sampling.
+// Each status class has its own counter, so the rate of one class does not depend on the traffic of the others.
+func (s *H2SProxyServer) sampleAudit(status int) bool {
+	n := s.profile.Load().AuditLog.SampleRate(status)
+	if n <= 1 {
+		return true
+	}
+	return s.auditRequests[status/100-1].Add(1)%uint64(n) == 1
+}
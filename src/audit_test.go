@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+func TestAuditLogWriteAfterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	m := newMetrics(true)
+	l, err := openAuditLog(domain.AuditLog{Path: path, MaxSize: 1 << 20, MaxFiles: 1}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.write([]byte(`{"status":200}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// audit records of hijacked tunnels can arrive after shutdown closed the log
+	if err := l.write([]byte(`{"status":502}`)); err != nil {
+		t.Errorf("write after Close: %v, want the record dropped", err)
+	}
+	if got := testutil.ToFloat64(m.auditDropped.c); got != 1 {
+		t.Errorf("audit_dropped_total %v, want 1", got)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte("{\"status\":200}\n")) {
+		t.Errorf("audit log holds %q, want only the record written before Close", data)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
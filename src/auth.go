@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+// proxyUser checks the Basic credentials in Proxy-Authorization and returns the authenticated user.
+func proxyUser(req *http.Request, auth domain.ProxyAuth) (string, bool) {
+	scheme, encoded, ok := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", false
+	}
+	want, known := auth.Users[user]
+	// compare even for unknown users so timing does not reveal which users exist
+	match := subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+	return user, known && match
+}
+
+// requireProxyAuth answers 407 asking the client for proxy credentials.
+func requireProxyAuth(wr http.ResponseWriter, auth domain.ProxyAuth) {
+	wr.Header().Set("Proxy-Authenticate", `Basic realm="`+auth.Realm+`"`)
+	http.Error(wr, "proxy authentication required", http.StatusProxyAuthRequired)
+}
+
+var errNoBearerToken = errors.New("no bearer token")
+
+// bearerClaims verifies the bearer token in Authorization against cfg and returns its claims.
+// The header is left in place: the token is usually meant for the origin as well.
+func bearerClaims(req *http.Request, cfg *domain.JWT, now time.Time) (map[string][]string, error) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, errNoBearerToken
+	}
+	return cfg.Verify(strings.TrimSpace(token), now)
+}
+
+// requireBearerToken answers 401 to a request without a valid bearer token, see RFC 6750.
+func requireBearerToken(wr http.ResponseWriter, err error) {
+	challenge := "Bearer"
+	if !errors.Is(err, errNoBearerToken) {
+		challenge += ` error="invalid_token"`
+	}
+	wr.Header().Set("WWW-Authenticate", challenge)
+	http.Error(wr, "valid bearer token required", http.StatusUnauthorized)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+// errNoHealthyRule is returned by matchRoute when rules match but the circuits of all of them are open.
+var errNoHealthyRule = errors.New("all matching rules have an open circuit")
+
+// breakers tracks consecutive upstream errors per rule name, so that state survives reloads keeping the name.
+type breakers struct {
+	mu    sync.Mutex
+	rules map[string]*breaker
+}
+
+type breaker struct {
+	failures  int
+	openUntil time.Time // zero while the circuit is closed
+	trialEnds time.Time // while half-open, other requests are skipped until the trial reports or this passes
+}
+
+func newBreakers() *breakers {
+	return &breakers{rules: make(map[string]*breaker)}
+}
+
+// allow reports whether a request may be sent through the rule. Once the cooldown of an open circuit has passed,
+// one request at a time is let through as a trial: success closes the circuit, an error reopens it.
+// Unless trial is set, the trial is not started, so that dry runs leave the circuit as it is.
+func (b *breakers) allow(rule string, now time.Time, cooldown time.Duration, trial bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.rules[rule]
+	if !ok || br.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(br.openUntil) || now.Before(br.trialEnds) {
+		return false
+	}
+	if trial {
+		// a trial whose outcome is never reported, e.g. because the client went away, blocks the rule for one cooldown at most
+		br.trialEnds = now.Add(cooldown)
+	}
+	return true
+}
+
+// record counts the outcome of a request through the rule and reports whether the circuit opened or closed.
+func (b *breakers) record(rule string, failed bool, now time.Time, cfg domain.CircuitBreaker) (opened, closed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.rules[rule]
+	if !failed {
+		if !ok {
+			return false, false
+		}
+		delete(b.rules, rule)
+		return false, !br.openUntil.IsZero()
+	}
+	if !ok {
+		br = &breaker{}
+		b.rules[rule] = br
+	}
+	br.failures++
+	if !br.openUntil.IsZero() {
+		// the trial failed
+		br.openUntil = now.Add(time.Duration(cfg.Cooldown))
+		br.trialEnds = time.Time{}
+		return false, false
+	}
+	if br.failures < cfg.Failures {
+		return false, false
+	}
+	br.openUntil = now.Add(time.Duration(cfg.Cooldown))
+	return true, false
+}
+
+// pickHealthy returns the first of the matched rules whose circuit allows a request, see breakers.allow for trial.
+// Deny and direct rules have no upstream to fail and are always taken.
+func (s *H2SProxyServer) pickHealthy(ctx context.Context, profile *domain.Profile, matched []domain.Rule, trial bool) (*domain.Rule, error) {
+	cfg := profile.CircuitBreaker
+	if !cfg.Enabled() {
+		return &matched[0], nil
+	}
+	now := s.clock.Now()
+	for i := range matched {
+		rule := &matched[i]
+		if rule.ProxyType == domain.ProxyTypeDeny || rule.ProxyType == domain.ProxyTypeDirect {
+			return rule, nil
+		}
+		if s.breakers.allow(rule.Name, now, time.Duration(cfg.Cooldown), trial) {
+			if i > 0 && trial {
+				s.loggerFor(ctx, nil).Debugw("circuit open, falling through", "rule", matched[0].Name, "fallback", rule.Name)
+			}
+			return rule, nil
+		}
+	}
+	return nil, errNoHealthyRule
+}
+
+// recordUpstream feeds the outcome of a request or tunnel through rule to its circuit breaker.
+// Errors caused by the client going away or by the certificate of the destination say nothing about the upstream.
+func (s *H2SProxyServer) recordUpstream(ctx context.Context, profile *domain.Profile, rule *domain.Rule, err error) {
+	cfg := profile.CircuitBreaker
+	if !cfg.Enabled() || rule == nil || rule.ProxyType == domain.ProxyTypeDirect {
+		return
+	}
+	if err != nil {
+		if _, ok := certErrorReason(err); ok || ctx.Err() != nil {
+			return
+		}
+	}
+	opened, closed := s.breakers.record(rule.Name, err != nil, s.clock.Now(), cfg)
+	switch {
+	case opened:
+		s.logger.Warnw("circuit opened", "rule", rule.Name, "failures", cfg.Failures, "cooldown", time.Duration(cfg.Cooldown), "error", err)
+		s.metrics.circuitOpen.set(1, rule.Name)
+	case closed:
+		s.logger.Infow("circuit closed", "rule", rule.Name)
+		s.metrics.circuitOpen.set(0, rule.Name)
+	}
+}
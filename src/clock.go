@@ -0,0 +1,14 @@
+package main
+
+import "time"
+
+// Clock is the time source of backoff and draining logic, so that it can be driven without real waits.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
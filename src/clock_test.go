@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeClock is a Clock that only moves when advanced, firing the After channels whose time has come.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+	added   chan struct{} // receives a value whenever After is called
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), added: make(chan struct{}, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, fakeTimer{at: c.now.Add(d), ch: ch})
+	}
+	c.added <- struct{}{}
+	return ch
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// waitAfter blocks until something calls After, so the test advances the clock only once the wait has started.
+func (c *fakeClock) waitAfter(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a call to After")
+	}
+}
+
+func TestBreakerCooldown(t *testing.T) {
+	s := newTestServer(t, `{
+  "version": 2,
+  "listen_addrs": ["127.0.0.1:0"],
+  "circuit_breaker": {"failures": 2, "cooldown": "30s"},
+  "rules": [
+    {"name": "primary", "patterns": ["10.0.0.0/8"], "proxy_ip": "192.0.2.1", "port": "1080"},
+    {"name": "secondary", "patterns": ["10.0.0.0/8"], "proxy_ip": "192.0.2.2", "port": "1080"}
+  ]
+}`)
+	clock := newFakeClock()
+	s.clock = clock
+	profile := s.profile.Load()
+	matched := profile.Rules
+	ctx := context.Background()
+	pick := func() string {
+		t.Helper()
+		rule, err := s.pickHealthy(ctx, profile, matched, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rule.Name
+	}
+	failed := errors.New("socks: connection refused")
+
+	s.recordUpstream(ctx, profile, &matched[0], failed)
+	if got := pick(); got != "primary" {
+		t.Fatalf("one failure: picked %v, want primary", got)
+	}
+	s.recordUpstream(ctx, profile, &matched[0], failed)
+	if got := pick(); got != "secondary" {
+		t.Fatalf("circuit open: picked %v, want secondary", got)
+	}
+	clock.Advance(29 * time.Second)
+	if got := pick(); got != "secondary" {
+		t.Fatalf("during cooldown: picked %v, want secondary", got)
+	}
+	clock.Advance(time.Second)
+	if got := pick(); got != "primary" {
+		t.Fatalf("after cooldown: picked %v for the trial, want primary", got)
+	}
+	if got := pick(); got != "secondary" {
+		t.Fatalf("trial in flight: picked %v, want secondary", got)
+	}
+	s.recordUpstream(ctx, profile, &matched[0], failed)
+	clock.Advance(29 * time.Second)
+	if got := pick(); got != "secondary" {
+		t.Fatalf("failed trial reopens for a cooldown: picked %v, want secondary", got)
+	}
+	clock.Advance(time.Second)
+	if got := pick(); got != "primary" {
+		t.Fatalf("second trial: picked %v, want primary", got)
+	}
+	s.recordUpstream(ctx, profile, &matched[0], nil)
+	if got := pick(); got != "primary" {
+		t.Fatalf("successful trial closes the circuit: picked %v, want primary", got)
+	}
+}
+
+func TestRetryAfterWaitsOnClock(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, `{"version": 2, "listen_addrs": ["127.0.0.1:0"], "retry": {"attempts": 1, "max_retry_after": "5m"}}`)
+	clock := newFakeClock()
+	s.clock = clock
+	profile := s.profile.Load()
+
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	type result struct {
+		res *http.Response
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := s.doWithRetry(upstream.Client(), req, profile.RetryFor(nil), profile.MaxBufferedBody, defaultRuleName, zap.NewNop().Sugar())
+		done <- result{res, err}
+	}()
+	clock.waitAfter(t)
+	clock.Advance(119 * time.Second)
+	select {
+	case r := <-done:
+		t.Fatalf("resent before Retry-After passed: %v, %v", r.res, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	r.res.Body.Close()
+	if r.res.StatusCode != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("got %v after %v upstream calls, want 200 after 2", r.res.StatusCode, calls.Load())
+	}
+}
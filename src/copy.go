@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBuffers pools the buffers used to stream bodies and tunnels, one pool per buffer size
+// since copy_buffer_size can change on reload.
+type copyBuffers struct {
+	mu    sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+func newCopyBuffers() *copyBuffers {
+	return &copyBuffers{pools: make(map[int]*sync.Pool)}
+}
+
+func (c *copyBuffers) pool(size int) *sync.Pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pools[size]
+	if !ok {
+		p = &sync.Pool{New: func() any {
+			b := make([]byte, size)
+			return &b
+		}}
+		c.pools[size] = p
+	}
+	return p
+}
+
+// copy is io.Copy with a pooled buffer of the given size.
+func (c *copyBuffers) copy(dst io.Writer, src io.Reader, size int) (int64, error) {
+	p := c.pool(size)
+	buf := p.Get().(*[]byte)
+	defer p.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// onlyReader and onlyWriter hide ReadFrom and WriteTo, as the hijacked client connections and SOCKS connections of tunnels do,
+// so copies go through a buffer.
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+func BenchmarkCopy(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	buffers := newCopyBuffers()
+	for _, bm := range []struct {
+		name string
+		copy func(dst io.Writer, src io.Reader) (int64, error)
+	}{
+		{"io.Copy", io.Copy},
+		{"pooled", func(dst io.Writer, src io.Reader) (int64, error) { return buffers.copy(dst, src, 32<<10) }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			src := onlyReader{bytes.NewReader(body)}
+			dst := onlyWriter{io.Discard}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for b.Loop() {
+				src.Reader.(*bytes.Reader).Reset(body)
+				if _, err := bm.copy(dst, src); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// answerPreflight responds to a CORS preflight request without contacting the upstream.
+// Origins that are not allowed get no CORS headers, so the browser refuses the actual request.
+func answerPreflight(wr http.ResponseWriter, req *http.Request, cors domain.CORS) {
+	origin := req.Header.Get("Origin")
+	h := wr.Header()
+	h.Add("Vary", "Origin")
+	allowAny := slices.Contains(cors.AllowedOrigins, "*")
+	if allowAny || slices.Contains(cors.AllowedOrigins, origin) {
+		if allowAny && !cors.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// credentialed requests must not be answered with the * wildcard
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cors.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if len(cors.AllowedMethods) > 0 {
+			h.Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+		}
+		if len(cors.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+		}
+		if cors.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(cors.MaxAge).Seconds())))
+		}
+	}
+	wr.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+// requestStats keeps the request counts shown on the status page and written to stats_file.
+type requestStats struct {
+	active atomic.Int64
+
+	mu     sync.Mutex
+	total  int64
+	byRule map[string]*ruleStats
+}
+
+// ruleStats counts the finished requests and tunnels of a rule.
+type ruleStats struct {
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`    // answered with a 5xx status
+	BytesIn  int64 `json:"bytes_in"`  // request bodies and tunnel bytes from clients
+	BytesOut int64 `json:"bytes_out"` // response bodies and tunnel bytes to clients
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{byRule: make(map[string]*ruleStats)}
+}
+
+func (st *requestStats) count(rule string, status int, bytesIn, bytesOut int64) {
+	st.mu.Lock()
+	st.total++
+	rs := st.byRule[rule]
+	if rs == nil {
+		rs = &ruleStats{}
+		st.byRule[rule] = rs
+	}
+	rs.Requests++
+	if status >= 500 {
+		rs.Errors++
+	}
+	rs.BytesIn += bytesIn
+	rs.BytesOut += bytesOut
+	st.mu.Unlock()
+}
+
+// requests returns the requests counted for rule. The caller must hold mu.
+func (st *requestStats) requests(rule string) int64 {
+	if rs := st.byRule[rule]; rs != nil {
+		return rs.Requests
+	}
+	return 0
+}
+
+// circuitState describes the circuit breaker of a rule for the status page.
+func (b *breakers) circuitState(rule string, now time.Time) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.rules[rule]
+	switch {
+	case !ok:
+		return "closed"
+	case br.openUntil.IsZero():
+		return "closed"
+	case now.Before(br.openUntil):
+		return "open for " + br.openUntil.Sub(now).Round(time.Second).String()
+	default:
+		return "half-open"
+	}
+}
+
+type statusRule struct {
+	Name     string
+	Type     string
+	Requests int64
+	Circuit  string
+}
+
+type statusPage struct {
+	Version  string
+	Uptime   time.Duration
+	Total    int64
+	Active   int64
+	Rules    []statusRule
+	Breakers bool
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>h2s-proxy status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+td.num { text-align: right; }
+</style>
+</head>
+<body>
+<h1>h2s-proxy {{.Version}}</h1>
+<p>Up {{.Uptime}}, {{.Total}} requests served, {{.Active}} in flight.</p>
+<table>
+<tr><th>rule</th><th>type</th><th>requests</th>{{if .Breakers}}<th>circuit</th>{{end}}</tr>
+{{range .Rules}}<tr><td>{{.Name}}</td><td>{{.Type}}</td><td class="num">{{.Requests}}</td>{{if $.Breakers}}<td>{{.Circuit}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// statusHandler renders the status page when admin.dashboard is enabled.
+func (s *H2SProxyServer) statusHandler(wr http.ResponseWriter, req *http.Request) {
+	profile := s.profile.Load()
+	if !profile.Admin.Dashboard {
+		http.NotFound(wr, req)
+		return
+	}
+	now := s.clock.Now()
+	page := statusPage{
+		Version:  version,
+		Uptime:   now.Sub(s.started).Round(time.Second),
+		Active:   s.stats.active.Load(),
+		Breakers: profile.CircuitBreaker.Enabled(),
+	}
+	s.stats.mu.Lock()
+	page.Total = s.stats.total
+	for i := range profile.Rules {
+		rule := &profile.Rules[i]
+		r := statusRule{Name: rule.Name, Type: rule.ProxyType, Requests: s.stats.requests(rule.Name), Circuit: "-"}
+		if rule.ProxyType == domain.ProxyTypeSOCKS5 {
+			r.Circuit = s.breakers.circuitState(rule.Name, now)
+		}
+		page.Rules = append(page.Rules, r)
+	}
+	page.Rules = append(page.Rules,
+		statusRule{Name: defaultRuleName, Type: domain.ProxyTypeDirect, Requests: s.stats.requests(defaultRuleName), Circuit: "-"},
+		statusRule{Name: ruleLabelNone + " (refused before matching)", Type: "-", Requests: s.stats.requests(ruleLabelNone), Circuit: "-"},
+	)
+	s.stats.mu.Unlock()
+	wr.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(wr, page); err != nil {
+		s.logger.Errorf("failed to render status page: %v", err)
+	}
+}
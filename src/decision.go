@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// decisionKey identifies a policy decision: the same host and port routed to the same rule is decided the same way.
+type decisionKey struct {
+	rule string
+	host string
+	port int
+}
+
+type decision struct {
+	addr, reason string // as returned by privateDestination, reason "" when allowed
+	expires      time.Time
+}
+
+// decisionCache keeps the block_private_networks decisions for hostnames for decision_cache_ttl. It is cleared
+// on reload, as the new profile may decide differently.
+type decisionCache struct {
+	mu      sync.Mutex
+	entries map[decisionKey]decision
+}
+
+func newDecisionCache() *decisionCache {
+	return &decisionCache{entries: make(map[decisionKey]decision)}
+}
+
+func (c *decisionCache) get(key decisionKey, now time.Time) (decision, bool) {
+	c.mu.Lock()
+	d, ok := c.entries[key]
+	c.mu.Unlock()
+	return d, ok && now.Before(d.expires)
+}
+
+func (c *decisionCache) put(key decisionKey, d decision, now time.Time, ttl time.Duration) {
+	d.expires = now.Add(ttl)
+	c.mu.Lock()
+	// drop expired entries now and then so the cache does not grow with every host ever requested
+	if len(c.entries) >= resolveCacheSweepSize {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = d
+	c.mu.Unlock()
+}
+
+func (c *decisionCache) clear() {
+	c.mu.Lock()
+	clear(c.entries)
+	c.mu.Unlock()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dnsServerTimeout bounds each query to one server, so a dead server costs seconds rather than the resolv.conf timeout
+	dnsServerTimeout = 2 * time.Second
+	// dnsServerCooldown is how long a server that failed a query is skipped
+	dnsServerCooldown = 30 * time.Second
+)
+
+// dnsResolvers caches a resolver per dns_servers list, joined by ",", so failover state is shared across transports.
+var dnsResolvers sync.Map
+
+// dnsResolver returns the resolver querying servers, a list of host:port joined by ",", or the system resolver when empty.
+func dnsResolver(servers string) *net.Resolver {
+	if servers == "" {
+		return net.DefaultResolver
+	}
+	if r, ok := dnsResolvers.Load(servers); ok {
+		return r.(*net.Resolver)
+	}
+	list := strings.Split(servers, ",")
+	d := &dnsDialer{servers: list, downUntil: make([]atomic.Int64, len(list))}
+	r, _ := dnsResolvers.LoadOrStore(servers, &net.Resolver{PreferGo: true, Dial: d.dial})
+	return r.(*net.Resolver)
+}
+
+// dnsDialer connects the Go resolver to the first configured server that has not failed recently,
+// whatever server it asked for. A failed query marks the server down, so the resolver's retry goes to the next one.
+type dnsDialer struct {
+	servers   []string
+	downUntil []atomic.Int64 // unix nanoseconds
+}
+
+func (d *dnsDialer) dial(ctx context.Context, network, _ string) (net.Conn, error) {
+	i := d.pick(time.Now())
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, network, d.servers[i])
+	if err != nil {
+		d.markDown(i)
+		return nil, err
+	}
+	conn := &dnsConn{Conn: c, dialer: d, server: i}
+	if pc, ok := c.(net.PacketConn); ok {
+		// the resolver frames queries by whether the connection is a PacketConn
+		return dnsPacketConn{dnsConn: conn, pc: pc}, nil
+	}
+	return conn, nil
+}
+
+// pick returns the first server not marked down, or the one whose cooldown ends first when all are.
+func (d *dnsDialer) pick(now time.Time) int {
+	best := 0
+	for i := range d.servers {
+		until := d.downUntil[i].Load()
+		if until <= now.UnixNano() {
+			return i
+		}
+		if until < d.downUntil[best].Load() {
+			best = i
+		}
+	}
+	return best
+}
+
+func (d *dnsDialer) markDown(i int) {
+	d.downUntil[i].Store(time.Now().Add(dnsServerCooldown).UnixNano())
+}
+
+// dnsConn caps the deadlines the resolver sets at dnsServerTimeout and marks its server down when a query fails.
+type dnsConn struct {
+	net.Conn
+	dialer *dnsDialer
+	server int
+}
+
+func (c *dnsConn) SetDeadline(t time.Time) error {
+	if limit := time.Now().Add(dnsServerTimeout); t.IsZero() || t.After(limit) {
+		t = limit
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *dnsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		// a timeout, or a refused port reported over UDP
+		c.dialer.markDown(c.server)
+	}
+	return n, err
+}
+
+type dnsPacketConn struct {
+	*dnsConn
+	pc net.PacketConn
+}
+
+func (c dnsPacketConn) ReadFrom(b []byte) (int, net.Addr, error) { return c.pc.ReadFrom(b) }
+
+func (c dnsPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) { return c.pc.WriteTo(b, addr) }
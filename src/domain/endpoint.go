@@ -0,0 +1,76 @@
+package domain
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Endpoint is one SOCKS server of a rule. Traffic is spread over a rule's endpoints in proportion to their weights.
+type Endpoint struct {
+	ProxyIP string `json:"proxy_ip"`
+	Port    string `json:"port"`
+	Weight  int    `json:"weight"` // defaults to 1
+}
+
+func (e Endpoint) Addr() string {
+	return net.JoinHostPort(e.ProxyIP, e.Port)
+}
+
+// balancer implements smooth weighted round-robin: over any window of total-weight picks,
+// each endpoint is chosen weight times, interleaved rather than in bursts.
+type balancer struct {
+	mu      sync.Mutex
+	current []int
+}
+
+func newBalancer(n int) *balancer {
+	return &balancer{current: make([]int, n)}
+}
+
+func (b *balancer) next(endpoints []Endpoint) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total, best := 0, 0
+	for i, ep := range endpoints {
+		b.current[i] += ep.Weight
+		total += ep.Weight
+		if b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// NextEndpoint picks the SOCKS endpoint for the next request matched by the rule.
+func (r *Rule) NextEndpoint() Endpoint {
+	if len(r.Endpoints) == 1 {
+		return r.Endpoints[0]
+	}
+	return r.Endpoints[r.balancer.next(r.Endpoints)]
+}
+
+// prepareEndpoints turns proxy_ip/port into a single endpoint when endpoints is not set.
+func (r *Rule) prepareEndpoints() {
+	if r.ProxyType != ProxyTypeSOCKS5 {
+		r.Endpoints = nil
+		return
+	}
+	if len(r.Endpoints) == 0 {
+		r.Endpoints = []Endpoint{{ProxyIP: r.ProxyIP, Port: r.Port}}
+	}
+	for i := range r.Endpoints {
+		if r.Endpoints[i].Weight == 0 {
+			r.Endpoints[i].Weight = 1
+		}
+	}
+	r.balancer = newBalancer(len(r.Endpoints))
+}
+
+func (e Endpoint) validate() error {
+	if e.Weight < 0 {
+		return fmt.Errorf("endpoint %v: weight must be positive", e.Addr())
+	}
+	return nil
+}
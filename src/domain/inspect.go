@@ -0,0 +1,51 @@
+package domain
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// Built-in response body inspectors.
+const (
+	InspectorScan   = "scan"   // count occurrences of Pattern
+	InspectorSHA256 = "sha256" // log the SHA-256 digest of the body
+)
+
+// BodyInspector configures a hook reading response bodies as they stream to the client.
+type BodyInspector struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Pattern      string   `json:"pattern"`       // literal bytes searched by scan
+	ContentTypes []string `json:"content_types"` // response media types inspected, all when empty
+}
+
+// Applies reports whether responses with contentType are inspected.
+func (b BodyInspector) Applies(contentType string) bool {
+	if len(b.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, ct := range b.ContentTypes {
+		if strings.EqualFold(ct, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b BodyInspector) validate() error {
+	switch b.Type {
+	case InspectorScan:
+		if b.Pattern == "" {
+			return fmt.Errorf("body inspector %q: scan requires a pattern", b.Name)
+		}
+	case InspectorSHA256:
+	default:
+		return fmt.Errorf("body inspector %q: unsupported type %q", b.Name, b.Type)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// rangePrefix marks a pattern given as an inclusive address range, e.g. "range:10.0.0.1-10.0.0.50".
+const rangePrefix = "range:"
+
+// parsePattern returns the networks a pattern covers: the network of a CIDR, or the fewest CIDRs spanning a range.
+func parsePattern(ptn string) ([]*net.IPNet, error) {
+	spec, ok := strings.CutPrefix(ptn, rangePrefix)
+	if !ok {
+		_, ipNet, err := net.ParseCIDR(ptn)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.IPNet{ipNet}, nil
+	}
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid range %q: want <start>-<end>", ptn)
+	}
+	start, err := netip.ParseAddr(strings.TrimSpace(from))
+	if err != nil {
+		return nil, fmt.Errorf("invalid range %q: %w", ptn, err)
+	}
+	end, err := netip.ParseAddr(strings.TrimSpace(to))
+	if err != nil {
+		return nil, fmt.Errorf("invalid range %q: %w", ptn, err)
+	}
+	if start.Is4() != end.Is4() || start.Zone() != "" || end.Zone() != "" {
+		return nil, fmt.Errorf("invalid range %q: start and end must be addresses of the same family", ptn)
+	}
+	if start.Compare(end) > 0 {
+		return nil, fmt.Errorf("invalid range %q: start is after end", ptn)
+	}
+	return rangeNets(start, end), nil
+}
+
+// rangeNets splits [start, end] into CIDRs, each the largest aligned block beginning at the first address left.
+func rangeNets(start, end netip.Addr) []*net.IPNet {
+	bits := start.BitLen()
+	var nets []*net.IPNet
+	for {
+		ones := bits
+		for ones > 0 {
+			wider := netip.PrefixFrom(start, ones-1).Masked()
+			if wider.Addr() != start || lastAddr(wider).Compare(end) > 0 {
+				break
+			}
+			ones--
+		}
+		nets = append(nets, &net.IPNet{IP: start.AsSlice(), Mask: net.CIDRMask(ones, bits)})
+		last := lastAddr(netip.PrefixFrom(start, ones))
+		if last == end {
+			return nets
+		}
+		start = last.Next()
+	}
+}
+
+// lastAddr returns the highest address of p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
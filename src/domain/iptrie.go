@@ -0,0 +1,71 @@
+package domain
+
+import (
+	"net"
+	"slices"
+)
+
+// ipTrie maps CIDR patterns to the indexes of the rules listing them.
+// A lookup walks at most one node per address bit, however many patterns there are.
+type ipTrie struct {
+	v4 trieNode
+	v6 trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	rules    []int // rules with a pattern ending at this prefix
+}
+
+func newIPTrie(rules []Rule) *ipTrie {
+	t := &ipTrie{}
+	for i := range rules {
+		for _, ipNet := range rules[i].ipNets {
+			t.insert(ipNet, i)
+		}
+	}
+	return t
+}
+
+// insert follows net.IPNet.Contains: IPv4 networks match IPv4 (and IPv4-mapped) addresses, IPv6 networks the rest.
+func (t *ipTrie) insert(ipNet *net.IPNet, rule int) {
+	root, ip := &t.v6, ipNet.IP.To16()
+	if len(ipNet.IP) == net.IPv4len {
+		root, ip = &t.v4, ipNet.IP
+	}
+	ones, _ := ipNet.Mask.Size()
+	node := root
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &trieNode{}
+		}
+		node = node.children[b]
+	}
+	if !slices.Contains(node.rules, rule) {
+		node.rules = append(node.rules, rule)
+	}
+}
+
+// lookup returns the indexes of all rules with a pattern containing ip, in rule order.
+func (t *ipTrie) lookup(ip net.IP) []int {
+	root := &t.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		root, ip = &t.v4, ip4
+	}
+	var found []int
+	node := root
+	for i := 0; node != nil; i++ {
+		found = append(found, node.rules...)
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[bit(ip, i)]
+	}
+	slices.Sort(found)
+	return slices.Compact(found)
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-i%8)) & 1
+}
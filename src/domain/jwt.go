@@ -0,0 +1,214 @@
+package domain
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // SHA-256 for HS256, RS256, PS256 and ES256
+	_ "crypto/sha512" // SHA-384 and SHA-512 for the other sizes
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JWT configures routing on the claims of a bearer token in the Authorization header.
+// It is disabled unless a verification key is set; tokens are checked against exactly one key.
+type JWT struct {
+	HMACKey   Secret `json:"hmac_key"`   // shared secret of HS256, HS384 and HS512 tokens
+	PublicKey string `json:"public_key"` // PEM RSA or ECDSA public key of RS*, PS* and ES* tokens
+	Issuer    string `json:"issuer"`     // required iss claim, any when empty
+	// answer 401 to requests without a valid token instead of routing them without claims
+	Required bool `json:"required"`
+
+	key crypto.PublicKey // parsed from PublicKey by prepare
+}
+
+func (j *JWT) Enabled() bool {
+	return j.HMACKey != "" || j.PublicKey != ""
+}
+
+func (j *JWT) prepare() error {
+	if j.HMACKey != "" && j.PublicKey != "" {
+		return errors.New("set either hmac_key or public_key")
+	}
+	if j.Required && !j.Enabled() {
+		return errors.New("required needs hmac_key or public_key")
+	}
+	if j.PublicKey == "" {
+		return nil
+	}
+	block, _ := pem.Decode([]byte(j.PublicKey))
+	if block == nil {
+		return errors.New("public_key: no PEM block")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("public_key: %w", err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return fmt.Errorf("public_key: unsupported key type %T", key)
+	}
+	j.key = key
+	return nil
+}
+
+// Verify checks the signature, expiry and issuer of token and returns its claims.
+// Each claim is flattened to its string values: scalars give one, arrays of scalars one per element, objects none.
+func (j *JWT) Verify(token string, now time.Time) (map[string][]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	if err := j.verifySignature(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	if exp, ok := numericDate(claims["exp"]); ok && !now.Before(exp) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Before(nbf) {
+		return nil, errors.New("token not valid yet")
+	}
+	if iss, _ := claims["iss"].(string); j.Issuer != "" && iss != j.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	return flattenClaims(claims), nil
+}
+
+// verifySignature checks sig over signed for alg. The algorithm must suit the configured key,
+// so an HMAC token cannot be forged with a public key as its secret, and "none" is never accepted.
+func (j *JWT) verifySignature(alg, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	if alg[:2] == "HS" && j.HMACKey != "" {
+		mac := hmac.New(hash.New, []byte(j.HMACKey))
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	var err error
+	switch key := j.key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(key, hash, digest, sig)
+		case "PS":
+			err = rsa.VerifyPSS(key, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return fmt.Errorf("alg %q does not suit an RSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" {
+			return fmt.Errorf("alg %q does not suit an ECDSA key", alg)
+		}
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			err = errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("alg %q does not suit the configured key", alg)
+	}
+	if err != nil {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func numericDate(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), true
+}
+
+func flattenClaims(claims map[string]any) map[string][]string {
+	flat := make(map[string][]string, len(claims))
+	for name, v := range claims {
+		if list, ok := v.([]any); ok {
+			for _, e := range list {
+				if s, ok := claimString(e); ok {
+					flat[name] = append(flat[name], s)
+				}
+			}
+			continue
+		}
+		if s, ok := claimString(v); ok {
+			flat[name] = []string{s}
+		}
+	}
+	return flat
+}
+
+func claimString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// LocationRewrites maps upstream hosts in absolute Location headers to ones clients can reach.
+// Keys are a host, matching any port, or a host:port. Values are the replacing host[:port],
+// or scheme://host[:port] to also change the scheme, e.g. when TLS ends in front of the proxy.
+type LocationRewrites map[string]string
+
+// prepare returns m with lowercased keys, after checking every mapping.
+func (m LocationRewrites) prepare() (LocationRewrites, error) {
+	if m == nil {
+		return nil, nil
+	}
+	prepared := make(LocationRewrites, len(m))
+	for from, to := range m {
+		if from == "" || strings.ContainsAny(from, "/?#") {
+			return nil, fmt.Errorf("rewrite_location: %q is not a host or host:port", from)
+		}
+		host := to
+		if scheme, rest, ok := strings.Cut(to, "://"); ok {
+			if scheme != "http" && scheme != "https" {
+				return nil, fmt.Errorf("rewrite_location: unsupported scheme %q in %q", scheme, to)
+			}
+			host = rest
+		}
+		if host == "" || strings.ContainsAny(host, "/?#") {
+			return nil, fmt.Errorf("rewrite_location: %q is not a host[:port] or scheme://host[:port]", to)
+		}
+		prepared[strings.ToLower(from)] = to
+	}
+	return prepared, nil
+}
+
+// Rewrite returns location with its host replaced when it is mapped. Relative locations and unmapped hosts are returned as is.
+// A mapping of host:port wins over one of the bare host.
+func (m LocationRewrites) Rewrite(location string) string {
+	if len(m) == 0 {
+		return location
+	}
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return location
+	}
+	to, ok := m[strings.ToLower(u.Host)]
+	if !ok {
+		if to, ok = m[strings.ToLower(u.Hostname())]; !ok {
+			return location
+		}
+	}
+	if scheme, host, found := strings.Cut(to, "://"); found {
+		u.Scheme, u.Host = scheme, host
+	} else {
+		u.Host = to
+	}
+	return u.String()
+}
@@ -0,0 +1,254 @@
+package domain
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const regexPrefix = "regex:"
+
+// Target holds the request attributes rules are matched against.
+type Target struct {
+	Host       string
+	Port       int // 0 when unknown
+	Header     http.Header
+	ServerName string              // TLS SNI, only known for CONNECT tunnels with peek_sni
+	IPs        []net.IP            // addresses Host resolved to, matched against patterns when Host is a name
+	User       string              // user authenticated by proxy_auth
+	Claims     map[string][]string // claims of the verified bearer token, see JWT.Verify
+	Time       time.Time           // when the request arrived, matched against active_windows; now when zero
+}
+
+// MatchRule returns the first rule matching target, in profile order.
+// Prepared profiles look up candidate rules by destination IP in a trie, add the rules with hostname patterns
+// matching the host, and only run the other matchers on those.
+func (p *Profile) MatchRule(target Target) (Rule, error) {
+	for _, i := range p.candidates(target) {
+		if p.Rules[i].matchRequest(target) {
+			return p.Rules[i], nil
+		}
+	}
+	return Rule{}, ErrNotFoundRule
+}
+
+// MatchRules returns every rule matching target, in profile order. The first one is the rule MatchRule returns.
+func (p *Profile) MatchRules(target Target) []Rule {
+	var matched []Rule
+	for _, i := range p.candidates(target) {
+		if p.Rules[i].matchRequest(target) {
+			matched = append(matched, p.Rules[i])
+		}
+	}
+	return matched
+}
+
+// ips returns the destination addresses: Host itself when it is an IP, otherwise its resolved addresses.
+func (t Target) ips() []net.IP {
+	if ip := net.ParseIP(t.Host); ip != nil {
+		return []net.IP{ip}
+	}
+	return t.IPs
+}
+
+// candidates returns the indexes of the rules with a pattern matching target, in rule order.
+func (p *Profile) candidates(target Target) []int {
+	ips := target.ips()
+	host := strings.ToLower(target.Host)
+	var found []int
+	if p.ipTrie == nil {
+		for i := range p.Rules {
+			if slices.ContainsFunc(ips, p.Rules[i].matchIP) || p.Rules[i].matchHost(host, target.Port) {
+				found = append(found, i)
+			}
+		}
+		return found
+	}
+	for _, ip := range ips {
+		found = append(found, p.ipTrie.lookup(ip)...)
+	}
+	merge := len(ips) > 1
+	for _, i := range p.hostRules {
+		if p.Rules[i].matchHost(host, target.Port) {
+			found = append(found, i)
+			merge = true
+		}
+	}
+	if merge {
+		slices.Sort(found)
+		found = slices.Compact(found)
+	}
+	return found
+}
+
+// MatchingPattern returns the first pattern of the rule containing a destination address of target,
+// or else the first hostname pattern matching it, or "" if none does.
+func (r *Rule) MatchingPattern(target Target) string {
+	for i, ipNet := range r.ipNets {
+		if slices.ContainsFunc(target.ips(), ipNet.Contains) {
+			return r.Patterns[r.netPatterns[i]]
+		}
+	}
+	host := strings.ToLower(target.Host)
+	for _, m := range r.hostMatchers {
+		if m.Match(host, target.Port) {
+			return r.Patterns[m.pattern]
+		}
+	}
+	return ""
+}
+
+// matchRequest applies the matchers other than patterns.
+func (r *Rule) matchRequest(target Target) bool {
+	return r.matchContentType(target.Header.Get("Content-Type")) && r.matchHeaders(target.Header) &&
+		r.matchServerName(target.ServerName) && r.matchUser(target.User) && r.matchClaims(target.Claims) && r.matchWindows(target.Time)
+}
+
+// matchClaims reports whether every claim in jwt_claims has the required value, or contains it for array claims.
+func (r *Rule) matchClaims(claims map[string][]string) bool {
+	for name, want := range r.JWTClaims {
+		if !slices.Contains(claims[name], want) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rule) matchUser(user string) bool {
+	return len(r.Users) == 0 || slices.Contains(r.Users, user)
+}
+
+func (r *Rule) compile() error {
+	r.ipNets = make([]*net.IPNet, 0, len(r.Patterns))
+	r.netPatterns = make([]int, 0, len(r.Patterns))
+	r.hostMatchers = nil
+	for i, ptn := range r.Patterns {
+		m, ok, err := compileMatcher(ptn)
+		if err != nil {
+			return fmt.Errorf("patterns: %w", err)
+		}
+		if ok {
+			r.hostMatchers = append(r.hostMatchers, patternMatcher{Matcher: m, pattern: i})
+			continue
+		}
+		ipNets, err := parsePattern(ptn)
+		if err != nil {
+			return fmt.Errorf("patterns: %w", err)
+		}
+		for _, ipNet := range ipNets {
+			r.ipNets = append(r.ipNets, ipNet)
+			r.netPatterns = append(r.netPatterns, i)
+		}
+	}
+	r.headerMatchers = nil
+	for name, value := range r.MatchHeaders {
+		m := headerMatcher{name: http.CanonicalHeaderKey(name), value: value}
+		if expr, ok := strings.CutPrefix(value, regexPrefix); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("match_headers %q: %w", name, err)
+			}
+			m.re = re
+		}
+		r.headerMatchers = append(r.headerMatchers, m)
+	}
+	for i := range r.ActiveWindows {
+		if err := r.ActiveWindows[i].compile(); err != nil {
+			return fmt.Errorf("active_windows[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// patternMatcher is the compiled form of Patterns[pattern].
+type patternMatcher struct {
+	Matcher
+	pattern int
+}
+
+// matchHost applies the hostname patterns. host must be lowercase.
+func (r *Rule) matchHost(host string, port int) bool {
+	for _, m := range r.hostMatchers {
+		if m.Match(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range r.ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchContentType compares media types only, ignoring parameters such as charset.
+func (r *Rule) matchContentType(contentType string) bool {
+	if len(r.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, ct := range r.ContentTypes {
+		if strings.EqualFold(ct, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHeaders requires every configured header to be present with at least one matching value.
+func (r *Rule) matchHeaders(header http.Header) bool {
+	for _, m := range r.headerMatchers {
+		if !m.match(header.Values(m.name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rule) matchServerName(serverName string) bool {
+	if len(r.ServerNames) == 0 {
+		return true
+	}
+	serverName = strings.ToLower(serverName)
+	for _, name := range r.ServerNames {
+		name = strings.ToLower(name)
+		if suffix, ok := strings.CutPrefix(name, "*"); ok {
+			if strings.HasSuffix(serverName, suffix) && len(serverName) > len(suffix) {
+				return true
+			}
+		} else if serverName == name {
+			return true
+		}
+	}
+	return false
+}
+
+type headerMatcher struct {
+	name  string
+	value string
+	re    *regexp.Regexp
+}
+
+func (m headerMatcher) match(values []string) bool {
+	for _, v := range values {
+		if m.re != nil && m.re.MatchString(v) || m.re == nil && v == m.value {
+			return true
+		}
+	}
+	return false
+}
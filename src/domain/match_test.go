@@ -0,0 +1,137 @@
+package domain
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// cidrProfile returns a prepared profile of n rules, each routing one /24 of 10.0.0.0/8 through its own SOCKS server.
+func cidrProfile(tb testing.TB, n int) *Profile {
+	tb.Helper()
+	p := &Profile{ListenAddrs: []string{"127.0.0.1:8080"}}
+	for i := range n {
+		p.Rules = append(p.Rules, Rule{
+			Name:     fmt.Sprintf("r%d", i),
+			Patterns: []string{fmt.Sprintf("10.%d.%d.0/24", i>>8&0xff, i&0xff)},
+			ProxyIP:  "192.0.2.1",
+			Port:     "1080",
+		})
+	}
+	if err := p.Prepare(); err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+// linear returns a copy of p without its trie, so candidates scans every rule.
+func linear(p *Profile) *Profile {
+	q := *p
+	q.ipTrie = nil
+	return &q
+}
+
+func TestTrieMatchesLinearScan(t *testing.T) {
+	p := cidrProfile(t, 1000)
+	p.Rules = append(p.Rules, Rule{Name: "wide", Patterns: []string{"10.0.0.0/8"}, ProxyIP: "192.0.2.1", Port: "1080"})
+	if err := p.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"10.0.0.1", "10.1.200.9", "10.3.231.255", "10.3.232.0", "10.200.0.1", "11.0.0.1", "::1", "example.com"} {
+		target := Target{Host: host}
+		trie, errTrie := p.MatchRule(target)
+		scan, errScan := linear(p).MatchRule(target)
+		if trie.Name != scan.Name || errTrie != errScan {
+			t.Errorf("%v: trie matched %q (%v), linear scan %q (%v)", host, trie.Name, errTrie, scan.Name, errScan)
+		}
+	}
+}
+
+func BenchmarkMatchRules(b *testing.B) {
+	p := cidrProfile(b, 5000)
+	// the last rule, which a linear scan reaches only after testing every other one
+	target := Target{Host: "10.19.135.7"}
+	for _, bm := range []struct {
+		name    string
+		profile *Profile
+	}{
+		{"trie", p},
+		{"linear", linear(p)},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			if rule, err := bm.profile.MatchRule(target); err != nil || rule.Name != "r4999" {
+				b.Fatalf("matched %q, %v", rule.Name, err)
+			}
+			b.ReportAllocs()
+			for b.Loop() {
+				bm.profile.MatchRule(target)
+			}
+		})
+	}
+}
+
+// matchRuleParsing is how MatchRule worked before patterns were compiled at load time: every CIDR of every rule
+// parsed again for each request.
+func matchRuleParsing(p *Profile, target Target) (Rule, error) {
+	ip := net.ParseIP(target.Host)
+	for _, rule := range p.Rules {
+		for _, ptn := range rule.Patterns {
+			_, ipNet, err := net.ParseCIDR(ptn)
+			if err != nil {
+				return Rule{}, err
+			}
+			if ipNet.Contains(ip) {
+				return rule, nil
+			}
+		}
+	}
+	return Rule{}, ErrNotFoundRule
+}
+
+func BenchmarkMatchRule(b *testing.B) {
+	// both scan the rules in order, the trie is left out to compare parsing with compiled patterns alone
+	p := linear(cidrProfile(b, 100))
+	target := Target{Host: "10.0.99.7"}
+	for _, bm := range []struct {
+		name  string
+		match func(Target) (Rule, error)
+	}{
+		{"parse per request", func(t Target) (Rule, error) { return matchRuleParsing(p, t) }},
+		{"compiled", p.MatchRule},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			if rule, err := bm.match(target); err != nil || rule.Name != "r99" {
+				b.Fatalf("matched %q, %v", rule.Name, err)
+			}
+			b.ReportAllocs()
+			for b.Loop() {
+				bm.match(target)
+			}
+		})
+	}
+}
+
+func TestRuleNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		names []string
+		ok    bool
+	}{
+		{name: "unique", names: []string{"a", "b"}, ok: true},
+		{name: "empty", names: []string{"a", ""}},
+		{name: "duplicate", names: []string{"a", "b", "a"}},
+		{name: "default", names: []string{"default"}},
+		{name: "none", names: []string{"none"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Profile{ListenAddrs: []string{"127.0.0.1:8080"}}
+			for _, name := range tt.names {
+				p.Rules = append(p.Rules, Rule{Name: name, Patterns: []string{"10.0.0.0/8"}, ProxyIP: "192.0.2.1", Port: "1080"})
+			}
+			if err := p.Prepare(); (err == nil) != tt.ok {
+				t.Errorf("rule names %q: got error %v, want ok %v", tt.names, err, tt.ok)
+			}
+		})
+	}
+}
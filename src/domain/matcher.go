@@ -0,0 +1,80 @@
+package domain
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Matcher matches destinations against a rule pattern that is not an address pattern. host is lowercase
+// and port is 0 when unknown. Address patterns (CIDRs and ranges) are indexed in a trie instead.
+type Matcher interface {
+	Match(host string, port int) bool
+}
+
+// MatcherFunc compiles the text following the prefix of a pattern into a Matcher.
+type MatcherFunc func(spec string) (Matcher, error)
+
+// matcherTypes maps pattern prefixes to the functions compiling them.
+var matcherTypes = map[string]MatcherFunc{
+	"glob:":     newGlobMatcher,
+	regexPrefix: newRegexMatcher,
+}
+
+// RegisterMatcher adds a pattern type: patterns starting with prefix, e.g. "suffix:", are compiled by newMatcher.
+// When prefixes overlap, the longest one a pattern starts with wins. It is not safe for concurrent use, so call it from an init function, before profiles are loaded.
+func RegisterMatcher(prefix string, newMatcher MatcherFunc) {
+	matcherTypes[prefix] = newMatcher
+}
+
+// compileMatcher returns the Matcher of ptn, or ok false when ptn has no registered prefix.
+func compileMatcher(ptn string) (m Matcher, ok bool, err error) {
+	var best string
+	for prefix := range matcherTypes {
+		if len(prefix) > len(best) && strings.HasPrefix(ptn, prefix) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return nil, false, nil
+	}
+	m, err = matcherTypes[best](ptn[len(best):])
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid pattern %q: %w", ptn, err)
+	}
+	return m, true, nil
+}
+
+// globMatcher matches hostnames with shell wildcards, e.g. "*.example.com" or "api-?.example.com".
+type globMatcher string
+
+func newGlobMatcher(spec string) (Matcher, error) {
+	spec = strings.ToLower(spec)
+	if _, err := path.Match(spec, ""); err != nil {
+		return nil, err
+	}
+	return globMatcher(spec), nil
+}
+
+func (m globMatcher) Match(host string, _ int) bool {
+	ok, _ := path.Match(string(m), host)
+	return ok
+}
+
+// regexMatcher matches hostnames with a regular expression, unanchored unless the expression says otherwise.
+type regexMatcher struct {
+	re *regexp.Regexp
+}
+
+func newRegexMatcher(spec string) (Matcher, error) {
+	re, err := regexp.Compile(spec)
+	if err != nil {
+		return nil, err
+	}
+	return regexMatcher{re: re}, nil
+}
+
+func (m regexMatcher) Match(host string, _ int) bool {
+	return m.re.MatchString(host)
+}
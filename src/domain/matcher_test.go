@@ -0,0 +1,127 @@
+package domain
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type matchCase struct {
+	host  string
+	port  int
+	match bool
+}
+
+// compileRule compiles a rule with patterns, failing the test on error.
+func compileRule(t *testing.T, patterns ...string) *Rule {
+	t.Helper()
+	r := &Rule{Name: "r", Patterns: patterns}
+	if err := r.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// checkMatches runs r against each case, matching hosts that are IPs against its address patterns as MatchRule does.
+func checkMatches(t *testing.T, r *Rule, cases []matchCase) {
+	t.Helper()
+	for _, c := range cases {
+		got := r.matchHost(strings.ToLower(c.host), c.port)
+		if ip := net.ParseIP(c.host); ip != nil {
+			got = got || r.matchIP(ip)
+		}
+		if got != c.match {
+			t.Errorf("%v on %s:%d = %v, want %v", r.Patterns, c.host, c.port, got, c.match)
+		}
+	}
+}
+
+func TestGlobMatcher(t *testing.T) {
+	checkMatches(t, compileRule(t, "glob:*.Example.com", "glob:api-?.internal"), []matchCase{
+		{host: "www.example.com", match: true},
+		{host: "a.b.example.com", match: true},
+		{host: "example.com"},
+		{host: "api-1.internal", match: true},
+		{host: "api-12.internal"},
+		{host: "www.example.com.evil"},
+	})
+}
+
+func TestRegexMatcher(t *testing.T) {
+	checkMatches(t, compileRule(t, `regex:^db[0-9]+\.corp$`, "regex:staging"), []matchCase{
+		{host: "db1.corp", match: true},
+		{host: "db.corp"},
+		{host: "db1.corp.example"},
+		{host: "app.staging.example", match: true},
+	})
+}
+
+func TestAddressPatterns(t *testing.T) {
+	checkMatches(t, compileRule(t, "10.1.0.0/16", "range:192.168.0.10-192.168.0.20", "2001:db8::/32"), []matchCase{
+		{host: "10.1.255.255", match: true},
+		{host: "10.2.0.0"},
+		{host: "192.168.0.9"},
+		{host: "192.168.0.10", match: true},
+		{host: "192.168.0.20", match: true},
+		{host: "192.168.0.21"},
+		{host: "2001:db8::1", match: true},
+		{host: "2001:db9::1"},
+		{host: "example.com"},
+	})
+}
+
+func TestInvalidPatterns(t *testing.T) {
+	for _, ptn := range []string{"glob:[", "regex:(", "10.0.0.0/33", "range:10.0.0.9-10.0.0.1", "range:10.0.0.1-::1", "example.com"} {
+		r := &Rule{Name: "r", Patterns: []string{ptn}}
+		if err := r.compile(); err == nil {
+			t.Errorf("pattern %q compiled, want an error", ptn)
+		}
+	}
+}
+
+// suffixMatcher matches hostnames ending in a suffix, and an optional port after a '|'.
+type suffixMatcher struct {
+	suffix string
+	port   string
+}
+
+func (m suffixMatcher) Match(host string, port int) bool {
+	return strings.HasSuffix(host, m.suffix) && (m.port == "" || m.port == strconv.Itoa(port))
+}
+
+func registerForTest(t *testing.T, prefix string, f MatcherFunc) {
+	t.Helper()
+	RegisterMatcher(prefix, f)
+	t.Cleanup(func() { delete(matcherTypes, prefix) })
+}
+
+func TestRegisteredMatcher(t *testing.T) {
+	registerForTest(t, "suffix:", func(spec string) (Matcher, error) {
+		suffix, port, _ := strings.Cut(spec, "|")
+		return suffixMatcher{suffix: suffix, port: port}, nil
+	})
+	checkMatches(t, compileRule(t, "suffix:.local", "suffix:.svc|8"), []matchCase{
+		{host: "printer.local", match: true},
+		{host: "local"},
+		{host: "api.svc", port: 8, match: true},
+		{host: "api.svc", port: 9},
+	})
+}
+
+func TestOverlappingPrefixes(t *testing.T) {
+	never := MatcherFunc(func(string) (Matcher, error) { return suffixMatcher{suffix: "\x00"}, nil })
+	always := MatcherFunc(func(string) (Matcher, error) { return suffixMatcher{}, nil })
+	registerForTest(t, "x:", never)
+	registerForTest(t, "x:y:", always)
+	// map iteration order varies between runs, so try enough times to catch an order dependency
+	for range 50 {
+		m, ok, err := compileMatcher("x:y:anything")
+		if err != nil || !ok {
+			t.Fatalf("compileMatcher: ok %v, err %v", ok, err)
+		}
+		if !m.Match("example.com", 0) {
+			t.Fatal("the shorter overlapping prefix won")
+		}
+	}
+}
@@ -1,43 +1,877 @@
 package domain
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var ErrNotFoundRule = errors.New("not found rule")
 
+// DefaultMaxForwardedFor is the longest X-Forwarded-For chain accepted unless the profile sets max_x_forwarded_for.
+const DefaultMaxForwardedFor = 30
+
+// X-Forwarded-For overflow handling.
+const (
+	ForwardedForReject   = "reject"
+	ForwardedForTruncate = "truncate"
+)
+
+// What to do when the admin listener cannot bind.
+const (
+	AdminBindFail     = "fail"     // abort startup
+	AdminBindContinue = "continue" // serve proxy traffic without the admin server
+)
+
+// DefaultRedactHeaders are masked in header logs unless the profile sets redact_headers.
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
 type Profile struct {
-	ServerHost string `json:"host"`
-	ServerPort string `json:"port"`
-	Rules      []Rule `json:"rules"`
+	Version     int      `json:"version"` // schema version, see ProfileVersion
+	ServerHost  string   `json:"host"`
+	ServerPort  string   `json:"port"`
+	ListenAddrs []string `json:"listen_addrs"` // takes precedence over host/port when set
+	ForceHTTP1  bool     `json:"force_http1"`
+	// follow upstream 3xx responses instead of passing them to the client
+	FollowRedirects bool   `json:"follow_redirects"`
+	Rules           []Rule `json:"rules"`
+
+	DenyStatus int `json:"deny_status"` // status of requests refused by policy, 403 by default
+	// refuse requests matching no rule instead of sending them directly
+	DenyUnmatched bool `json:"deny_unmatched"`
+	// refuse destinations in loopback, link-local, RFC 1918 and unique local ranges, unless a rule allows them
+	BlockPrivateNetworks bool `json:"block_private_networks"`
+	// how long block_private_networks decisions on hostnames are reused, not cached when zero
+	DecisionCacheTTL Duration `json:"decision_cache_ttl"`
+	// destination ports refused before matching, e.g. 25 against spam relaying
+	BlockedPorts []int `json:"blocked_ports"`
+	// ports CONNECT tunnels may target, e.g. 443 and 563; any port when empty
+	ConnectPorts []int `json:"connect_ports"`
+	// methods the proxy relays, all when empty; others get 405
+	AllowedMethods []string `json:"allowed_methods"`
+	// status of requests whose upstream TLS certificate failed verification, 502 by default
+	CertErrorStatus int `json:"cert_error_status"`
+	// status of requests for a URL scheme other than http and https, or without an absolute URL, 400 by default
+	UnsupportedSchemeStatus int `json:"unsupported_scheme_status"`
+
+	// accept plain HTTP connections redirected by iptables, Linux only
+	Transparent bool `json:"transparent"`
+	// read the TLS ClientHello of CONNECT tunnels so rules can match its SNI
+	PeekSNI bool `json:"peek_sni"`
+
+	// resolve hostnames matching no rule and match their addresses against patterns
+	ResolveHostnames bool     `json:"resolve_hostnames"`
+	ResolveCacheTTL  Duration `json:"resolve_cache_ttl"` // 1m by default
+	// most lookups of uncached hostnames running at once, 64 by default; further lookups wait for a slot
+	ResolveConcurrency int `json:"resolve_concurrency"`
+	// DNS servers used instead of the system resolver for local lookups, tried in order; ":53" is added when no port is given
+	DNSServers []string `json:"dns_servers"`
+
+	Pool   Pool   `json:"pool"`
+	Retry  Retry  `json:"retry"`
+	Warmup Warmup `json:"warmup"`
+	// periodically close the idle upstream connections of rarely used transports
+	IdleSweep IdleSweep `json:"idle_sweep"`
+	// answer new requests with 503 while too many client connections are open
+	LoadShedding LoadShedding `json:"load_shedding"`
+	// skip matching rules whose upstream keeps failing in favour of the next matching rule
+	CircuitBreaker CircuitBreaker `json:"circuit_breaker"`
+	// request bodies up to this size are buffered so retries can replay them
+	MaxBufferedBody int64 `json:"max_buffered_body"`
+	// size of the pooled buffers response bodies and tunnels are streamed through
+	CopyBufferSize int `json:"copy_buffer_size"`
+	// socket options of tunneled and upstream connections
+	TCP TCPOptions `json:"tcp"`
+
+	// header set to the client IP for origins expecting e.g. True-Client-IP
+	ClientIPHeader      string `json:"client_ip_header"`
+	DisableForwardedFor bool   `json:"disable_x_forwarded_for"`
+	// drop X-Forwarded-For entries repeating the one before them
+	CollapseForwardedFor bool `json:"collapse_x_forwarded_for"`
+	// longest X-Forwarded-For chain forwarded, including the client IP; DefaultMaxForwardedFor when zero
+	MaxForwardedFor int `json:"max_x_forwarded_for"`
+	// what to do with longer chains: reject (default) with 400, or truncate to the most recent entries
+	ForwardedForOverflow string `json:"x_forwarded_for_overflow"`
+	// also append an RFC 7239 Forwarded header
+	Forwarded bool `json:"forwarded"`
+	// request headers set on every request sent upstream, e.g. an API key; rules extend and override them
+	SetHeaders SetHeaders `json:"set_headers"`
+
+	// upstream response headers removed before relaying, e.g. Server or X-Powered-By
+	StripResponseHeaders []string `json:"strip_response_headers"`
+	// upstream hosts in absolute Location headers of responses replaced by ones clients can reach
+	RewriteLocation LocationRewrites `json:"rewrite_location"`
+
+	// hooks reading response bodies as they stream to the client
+	BodyInspectors []BodyInspector `json:"body_inspectors"`
+
+	// log request and response headers at debug level, masking RedactHeaders
+	LogHeaders    bool     `json:"log_headers"`
+	RedactHeaders []string `json:"redact_headers"`
+	// emit the debug logs of only 1 in this many requests, those of every request when 0 or 1
+	DebugLogSampling int `json:"debug_log_sampling"`
+	// include the error of a failed upstream request in the 5xx response body, for local troubleshooting only
+	ExposeUpstreamErrors bool `json:"expose_upstream_errors"`
+
+	// require clients to authenticate to the proxy with Basic credentials
+	ProxyAuth ProxyAuth `json:"proxy_auth"`
+	// verify bearer tokens so rules can match on their claims
+	JWT JWT `json:"jwt"`
+
+	// default SOCKS credentials for rules that do not set their own
+	Username string `json:"username"`
+	Password Secret `json:"password"`
+
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	// time allowed for the upstream to send the response headers once the request is written, unbounded when zero
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"`
+	// hard bound on a proxied request from arrival to the end of the response body, unbounded when zero
+	MaxRequestDuration Duration `json:"max_request_duration"`
+
+	Admin Admin `json:"admin"`
+	Pprof Pprof `json:"pprof"`
+	// record no metrics, taking their cost off the request path; read at startup only
+	DisableMetrics bool     `json:"disable_metrics"`
+	Tracing        Tracing  `json:"tracing"`
+	AuditLog       AuditLog `json:"audit_log"`
+	// file the per-rule request, error and byte counts are written to on graceful shutdown, none when empty
+	StatsFile string `json:"stats_file"`
+
+	// added to every response when Name is set, e.g. X-Proxied-By
+	ProxiedByHeader HeaderField `json:"proxied_by_header"`
+
+	// User-Agent of requests made by the proxy itself, h2s-proxy/<version> by default
+	UserAgent string `json:"user_agent"`
+	// name added to the Via header of forwarded requests; requests already carrying it get 508. No detection when empty
+	ProxyID string `json:"proxy_id"`
+
+	// answer CORS preflight requests locally when origins are listed
+	CORS CORS `json:"cors"`
+
+	Maintenance Maintenance `json:"maintenance"`
+
+	ipTrie    *ipTrie // built from the rule patterns by Prepare
+	hostRules []int   // rules with hostname patterns, which the trie cannot index
+	// set_headers of the default route; those of rules are merged into Rule.setHeaders
+	setHeaders []HeaderField
+}
+
+type HeaderField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ProxyAuth holds the users allowed to use the proxy. Authentication is off when Users is empty.
+type ProxyAuth struct {
+	Realm string            `json:"realm"` // defaults to h2s-proxy
+	Users map[string]Secret `json:"users"` // user name to password
+}
+
+func (a ProxyAuth) Enabled() bool {
+	return len(a.Users) > 0
 }
 
+// CORS holds the headers CORS preflight requests are answered with.
+// Preflights are forwarded to the upstream when AllowedOrigins is empty.
+type CORS struct {
+	AllowedOrigins   []string `json:"allowed_origins"` // "*" allows any origin
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           Duration `json:"max_age"` // how long browsers may cache the answer
+}
+
+// Admin configures the listener serving operational endpoints such as /metrics.
+// It is disabled when Addr is empty.
+type Admin struct {
+	Addr string `json:"addr"`
+	// required as a bearer token on every admin request when set, and must be set unless Addr is a loopback address
+	Token Secret `json:"token"`
+	// serve an HTML status page on /status
+	Dashboard bool `json:"dashboard"`
+	// fail (default) to abort startup when Addr cannot be bound, or continue without the admin server
+	OnBindError string `json:"on_bind_error"`
+}
+
+// Pprof configures the listener serving the net/http/pprof handlers, never one of the proxy or admin listeners.
+// It is disabled unless Enabled is set.
+type Pprof struct {
+	Enabled bool   `json:"enabled"`
+	Addr    string `json:"addr"` // 127.0.0.1:6060 by default
+}
+
+// Tracing configures export of request spans over OTLP/HTTP. It is disabled when OTLPEndpoint is empty.
+type Tracing struct {
+	OTLPEndpoint string `json:"otlp_endpoint"` // host:port of the collector
+	Insecure     bool   `json:"insecure"`      // plain HTTP instead of HTTPS
+	ServiceName  string `json:"service_name"`  // defaults to h2s-proxy
+}
+
+// AuditLog configures the file recording every proxied request as a JSON line, independent of the log level.
+// The file is written when Path is set and rotated to Path.1, Path.2, ... once it reaches MaxSize.
+type AuditLog struct {
+	Path     string `json:"path"`
+	MaxSize  int64  `json:"max_size"`  // bytes, 100 MiB by default
+	MaxFiles int    `json:"max_files"` // rotated files kept, 5 by default
+	// keep the record of 1 in that many requests by status class, e.g. {"2xx": 100}; classes not listed are all kept
+	Sampling map[string]int `json:"sampling"`
+	// also, or only, ship the records to syslog
+	Syslog Syslog `json:"syslog"`
+}
+
+// StatusClass returns the first digit of a status class written as "2xx", or 0 when class is not one of 1xx to 5xx.
+func StatusClass(class string) int {
+	if len(class) != 3 || class[1:] != "xx" || class[0] < '1' || class[0] > '5' {
+		return 0
+	}
+	return int(class[0] - '0')
+}
+
+// SampleRate returns the audit sampling of status: 1 in how many records of its class are kept, 0 or 1 keeping all.
+func (a AuditLog) SampleRate(status int) int {
+	if status < 100 || status > 599 {
+		return 1
+	}
+	return a.Sampling[strconv.Itoa(status/100)+"xx"]
+}
+
+// Syslog configures the syslog endpoint audit records are shipped to. It is disabled when Addr is empty.
+type Syslog struct {
+	Addr       string `json:"addr"`        // host:port
+	Network    string `json:"network"`     // udp (default) or tcp
+	Tag        string `json:"tag"`         // APP-NAME of the messages, h2s-proxy by default
+	BufferSize int    `json:"buffer_size"` // records queued while the endpoint is slow or down, 1024 by default
+}
+
+func (s *Syslog) setDefaults() {
+	if s.Network == "" {
+		s.Network = "udp"
+	}
+	if s.Tag == "" {
+		s.Tag = "h2s-proxy"
+	}
+	if s.BufferSize == 0 {
+		s.BufferSize = 1024
+	}
+}
+
+func (s Syslog) validate() error {
+	switch s.Network {
+	case "udp", "tcp":
+	default:
+		return fmt.Errorf("audit_log.syslog: unsupported network %q", s.Network)
+	}
+	if s.BufferSize < 0 {
+		return errors.New("audit_log.syslog: buffer_size must not be negative")
+	}
+	return nil
+}
+
+// Maintenance configures answering requests with 503 while upstreams are worked on.
+// It is switched on from the admin server, or by creating File.
+type Maintenance struct {
+	// maintenance is on while this file exists; unless it is empty, it lists the rules concerned, one name per line
+	File       string   `json:"file"`
+	RetryAfter Duration `json:"retry_after"` // Retry-After of the 503 responses, 5m by default
+}
+
+const (
+	ProxyTypeSOCKS5 = "socks5"
+	ProxyTypeDirect = "direct" // connect to the destination without a proxy
+	ProxyTypeDeny   = "deny"   // refuse matching requests
+)
+
 type Rule struct {
-	Name      string   `json:"name"`
-	ProxyType string   `json:"proxy_type"` // socks5 only
-	ProxyIP   string   `json:"proxy_ip"`
-	Port      string   `json:"port"`
-	Patterns  []string `json:"patterns"`
+	Name      string     `json:"name"`
+	Order     int        `json:"order"`      // rules are matched by ascending order, ties in file order
+	ProxyType string     `json:"proxy_type"` // socks5 (default) or direct
+	ProxyIP   string     `json:"proxy_ip"`
+	Port      string     `json:"port"`
+	Endpoints []Endpoint `json:"endpoints"` // several SOCKS servers instead of proxy_ip/port
+	Patterns  []string   `json:"patterns"`  // CIDRs, "range:<start>-<end>", "glob:<hostname>" or "regex:<expr>"
+	Username  string     `json:"username"`
+	Password  Secret     `json:"password"`
+	// optional request matchers, combined with patterns using AND
+	ContentTypes []string          `json:"content_types"`
+	MatchHeaders map[string]string `json:"match_headers"` // exact value, or "regex:<expr>"
+	ServerNames  []string          `json:"server_names"`  // TLS SNI of CONNECT tunnels, "*.example.com" allowed
+	Users        []string          `json:"users"`         // proxy_auth users
+	JWTClaims    map[string]string `json:"jwt_claims"`    // claim name to the required value of a verified bearer token
+	// times of the week the rule applies, skipped outside all of them; always when empty
+	ActiveWindows []ActiveWindow `json:"active_windows"`
+
+	ForceHTTP1      *bool        `json:"force_http1"`      // overrides Profile.ForceHTTP1 when set
+	FollowRedirects *bool        `json:"follow_redirects"` // overrides Profile.FollowRedirects when set
+	SourceIP        string       `json:"source_ip"`        // local address outbound connections originate from
+	Network         string       `json:"network"`          // tcp, tcp4 or tcp6 for connections to the SOCKS server, tcp by default
+	Pool            Pool         `json:"pool"`             // overrides Profile.Pool field by field
+	Retry           Retry        `json:"retry"`            // overrides Profile.Retry field by field
+	HeaderLimits    HeaderLimits `json:"header_limits"`    // bounds on the request headers forwarded
+	HeaderOrder     []string     `json:"header_order"`     // request headers sent first, in this order, over HTTP/1.1
+	Concurrency     Concurrency  `json:"concurrency"`      // cap on requests and tunnels open upstream at once
+	Critical        bool         `json:"critical"`         // with --preflight, refuse to start unless an endpoint is reachable
+	// minimum level of the per-request logs of the rule, e.g. warn to silence a busy route
+	LogLevel string `json:"log_level"`
+	// exempts the rule from Profile.BlockPrivateNetworks, e.g. for a SOCKS route into an internal network
+	AllowPrivateNetworks bool `json:"allow_private_networks"`
+	// request headers forwarded upstream, dropping the others except those the body needs; all when empty
+	AllowedRequestHeaders []string `json:"allowed_request_headers"`
+	// extends and overrides Profile.SetHeaders, "" leaving a profile header unset
+	SetHeaders SetHeaders `json:"set_headers"`
+	// replaces Profile.StripResponseHeaders when set, [] strips nothing
+	StripResponseHeaders []string `json:"strip_response_headers"`
+	// replaces Profile.RewriteLocation when set, {} rewrites nothing
+	RewriteLocation LocationRewrites `json:"rewrite_location"`
+	// overrides Profile.ResponseHeaderTimeout when set, "0s" waits without bound
+	ResponseHeaderTimeout *Duration `json:"response_header_timeout"`
+
+	ipNets         []*net.IPNet
+	netPatterns    []int // index in Patterns of each of ipNets, as a range pattern spans several networks
+	hostMatchers   []patternMatcher
+	setHeaders     []HeaderField // Profile.SetHeaders merged with SetHeaders
+	headerMatchers []headerMatcher
+	balancer       *balancer
 }
 
-func (p *Profile) GetServerAddr() string {
-	return fmt.Sprintf("%v:%v", p.ServerHost, p.ServerPort)
+// GetServerAddrs returns every address the proxy server should listen on.
+func (p *Profile) GetServerAddrs() []string {
+	if len(p.ListenAddrs) > 0 {
+		return p.ListenAddrs
+	}
+	return []string{net.JoinHostPort(p.ServerHost, p.ServerPort)}
 }
 
-func (p *Profile) MatchRule(path string) (Rule, error) {
-	for _, rule := range p.Rules {
-		for _, ptn := range rule.Patterns {
-			ip := net.ParseIP(path)
-			_, ipNet, err := net.ParseCIDR(ptn)
-			if err != nil {
-				return Rule{}, err
-			}
-			if ipNet.Contains(ip) {
-				return rule, nil
+// AllowsMethod reports whether requests with method may be relayed.
+func (p *Profile) AllowsMethod(method string) bool {
+	return len(p.AllowedMethods) == 0 || slices.Contains(p.AllowedMethods, method)
+}
+
+// PortBlocked reports whether the destination port is in blocked_ports.
+func (p *Profile) PortBlocked(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && slices.Contains(p.BlockedPorts, n)
+}
+
+// ConnectPortAllowed reports whether a CONNECT tunnel may target port under connect_ports.
+func (p *Profile) ConnectPortAllowed(port string) bool {
+	if len(p.ConnectPorts) == 0 {
+		return true
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && slices.Contains(p.ConnectPorts, n)
+}
+
+// HTTP1Only reports whether upstream requests for the rule must stay on HTTP/1.1.
+// A nil rule stands for the default direct route.
+func (p *Profile) HTTP1Only(rule *Rule) bool {
+	if rule != nil && rule.ForceHTTP1 != nil {
+		return *rule.ForceHTTP1
+	}
+	return p.ForceHTTP1
+}
+
+// RetryFor returns the retry policy for the rule, or the profile policy for the default direct route.
+func (p *Profile) RetryFor(rule *Rule) Retry {
+	if rule != nil {
+		return rule.Retry
+	}
+	return p.Retry
+}
+
+// FollowRedirectsFor reports whether upstream redirects are followed for the rule.
+// A nil rule stands for the default direct route.
+func (p *Profile) FollowRedirectsFor(rule *Rule) bool {
+	if rule != nil && rule.FollowRedirects != nil {
+		return *rule.FollowRedirects
+	}
+	return p.FollowRedirects
+}
+
+// StripResponseHeadersFor returns the response headers removed for the rule.
+// A nil rule stands for the default direct route.
+func (p *Profile) StripResponseHeadersFor(rule *Rule) []string {
+	if rule != nil && rule.StripResponseHeaders != nil {
+		return rule.StripResponseHeaders
+	}
+	return p.StripResponseHeaders
+}
+
+// RewriteLocationFor returns the Location rewrites of responses for the rule.
+// A nil rule stands for the default direct route.
+func (p *Profile) RewriteLocationFor(rule *Rule) LocationRewrites {
+	if rule != nil && rule.RewriteLocation != nil {
+		return rule.RewriteLocation
+	}
+	return p.RewriteLocation
+}
+
+// ResponseHeaderTimeoutFor returns how long to wait for the upstream response headers for the rule.
+// A nil rule stands for the default direct route.
+func (p *Profile) ResponseHeaderTimeoutFor(rule *Rule) time.Duration {
+	if rule != nil && rule.ResponseHeaderTimeout != nil {
+		return time.Duration(*rule.ResponseHeaderTimeout)
+	}
+	return time.Duration(p.ResponseHeaderTimeout)
+}
+
+// Prepare resolves settings rules inherit from the profile, compiles their matchers
+// and validates the result. It must be called once after the profile is decoded.
+func (p *Profile) Prepare() error {
+	if p.RedactHeaders == nil {
+		p.RedactHeaders = DefaultRedactHeaders
+	}
+	if p.DenyStatus == 0 {
+		p.DenyStatus = http.StatusForbidden
+	}
+	for i, m := range p.AllowedMethods {
+		// methods are case-sensitive, but lowercase ones would only be typos in practice
+		p.AllowedMethods[i] = strings.ToUpper(m)
+	}
+	if p.MaxForwardedFor == 0 {
+		p.MaxForwardedFor = DefaultMaxForwardedFor
+	}
+	if p.ForwardedForOverflow == "" {
+		p.ForwardedForOverflow = ForwardedForReject
+	}
+	if p.CertErrorStatus == 0 {
+		p.CertErrorStatus = http.StatusBadGateway
+	}
+	if p.UnsupportedSchemeStatus == 0 {
+		p.UnsupportedSchemeStatus = http.StatusBadRequest
+	}
+	if p.ProxyAuth.Realm == "" {
+		p.ProxyAuth.Realm = "h2s-proxy"
+	}
+	if p.Admin.OnBindError == "" {
+		p.Admin.OnBindError = AdminBindFail
+	}
+	if p.Pprof.Enabled && p.Pprof.Addr == "" {
+		p.Pprof.Addr = "127.0.0.1:6060"
+	}
+	if p.Tracing.ServiceName == "" {
+		p.Tracing.ServiceName = "h2s-proxy"
+	}
+	if p.AuditLog.MaxSize == 0 {
+		p.AuditLog.MaxSize = 100 << 20
+	}
+	if p.AuditLog.MaxFiles == 0 {
+		p.AuditLog.MaxFiles = 5
+	}
+	p.AuditLog.Syslog.setDefaults()
+	if p.MaxBufferedBody == 0 {
+		p.MaxBufferedBody = DefaultMaxBufferedBody
+	}
+	for i, server := range p.DNSServers {
+		if net.ParseIP(server) != nil || strings.HasPrefix(server, "[") && strings.HasSuffix(server, "]") {
+			p.DNSServers[i] = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+	}
+	if p.ResolveCacheTTL == 0 {
+		p.ResolveCacheTTL = Duration(time.Minute)
+	}
+	if p.ResolveConcurrency == 0 {
+		p.ResolveConcurrency = 64
+	}
+	if p.Maintenance.RetryAfter == 0 {
+		p.Maintenance.RetryAfter = Duration(5 * time.Minute)
+	}
+	if p.CopyBufferSize == 0 {
+		p.CopyBufferSize = DefaultCopyBufferSize
+	}
+	p.Warmup.setDefaults()
+	p.LoadShedding.setDefaults()
+	p.CircuitBreaker.setDefaults()
+	p.TCP.setDefaults()
+	var err error
+	if p.RewriteLocation, err = p.RewriteLocation.prepare(); err != nil {
+		return err
+	}
+	if p.SetHeaders, err = p.SetHeaders.prepare(false); err != nil {
+		return err
+	}
+	p.setHeaders = mergeSetHeaders(p.SetHeaders, nil)
+	p.Pool = p.Pool.inherit(DefaultPool)
+	p.Retry = p.Retry.inherit(DefaultRetry)
+	// the trie and every index into Rules rely on this order being the match precedence
+	slices.SortStableFunc(p.Rules, func(a, b Rule) int { return cmp.Compare(a.Order, b.Order) })
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		rule.Pool = rule.Pool.inherit(p.Pool)
+		rule.Retry = rule.Retry.inherit(p.Retry)
+		if rule.ProxyType == "" {
+			rule.ProxyType = ProxyTypeSOCKS5
+		}
+		if rule.Network == "" {
+			rule.Network = "tcp"
+		}
+		rule.prepareEndpoints()
+		for i, name := range rule.HeaderOrder {
+			rule.HeaderOrder[i] = http.CanonicalHeaderKey(name)
+		}
+		for i, name := range rule.AllowedRequestHeaders {
+			rule.AllowedRequestHeaders[i] = http.CanonicalHeaderKey(name)
+		}
+		if rule.Username == "" {
+			rule.Username = p.Username
+			rule.Password = p.Password
+		}
+		if rule.RewriteLocation, err = rule.RewriteLocation.prepare(); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if rule.SetHeaders, err = rule.SetHeaders.prepare(true); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		rule.setHeaders = mergeSetHeaders(p.SetHeaders, rule.SetHeaders)
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+	}
+	if err := p.JWT.prepare(); err != nil {
+		return fmt.Errorf("jwt: %w", err)
+	}
+	p.ipTrie = newIPTrie(p.Rules)
+	p.hostRules = nil
+	for i := range p.Rules {
+		if len(p.Rules[i].hostMatchers) > 0 {
+			p.hostRules = append(p.hostRules, i)
+		}
+	}
+	return p.Validate()
+}
+
+// Validate checks that the profile is usable before the server starts.
+func (p *Profile) Validate() error {
+	for _, addr := range p.GetServerAddrs() {
+		if err := validateListenAddr(addr); err != nil {
+			return err
+		}
+	}
+	if p.Admin.Addr != "" {
+		if err := validateListenAddr(p.Admin.Addr); err != nil {
+			return fmt.Errorf("admin: %w", err)
+		}
+		if p.Admin.Token == "" && !isLoopbackAddr(p.Admin.Addr) {
+			return fmt.Errorf("admin: token is required when addr %q is not a loopback address", p.Admin.Addr)
+		}
+	}
+	switch p.Admin.OnBindError {
+	case AdminBindFail, AdminBindContinue:
+	default:
+		return fmt.Errorf("admin: unsupported on_bind_error %q", p.Admin.OnBindError)
+	}
+	if p.Pprof.Enabled {
+		if err := validateListenAddr(p.Pprof.Addr); err != nil {
+			return fmt.Errorf("pprof: %w", err)
+		}
+		for _, addr := range append(p.GetServerAddrs(), p.Admin.Addr) {
+			if addr != "" && sharesPort(p.Pprof.Addr, addr) {
+				return fmt.Errorf("pprof: addr %q must differ from the proxy and admin listener %q", p.Pprof.Addr, addr)
 			}
 		}
 	}
-	return Rule{}, ErrNotFoundRule
+	if p.DenyStatus < 400 || p.DenyStatus > 599 {
+		return fmt.Errorf("deny_status must be a 4xx or 5xx status, got %v", p.DenyStatus)
+	}
+	if p.CertErrorStatus < 400 || p.CertErrorStatus > 599 {
+		return fmt.Errorf("cert_error_status must be a 4xx or 5xx status, got %v", p.CertErrorStatus)
+	}
+	if p.UnsupportedSchemeStatus < 400 || p.UnsupportedSchemeStatus > 599 {
+		return fmt.Errorf("unsupported_scheme_status must be a 4xx or 5xx status, got %v", p.UnsupportedSchemeStatus)
+	}
+	for _, server := range p.DNSServers {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("dns_servers: %q is not an IP address with an optional port", server)
+		}
+	}
+	if p.ResolveCacheTTL < 0 {
+		return fmt.Errorf("resolve_cache_ttl must not be negative, got %v", time.Duration(p.ResolveCacheTTL))
+	}
+	if p.ProxyID != "" && strings.ContainsFunc(p.ProxyID, func(r rune) bool { return r <= ' ' || r == ',' || r == '(' || r == ')' || r >= 0x7f }) {
+		return fmt.Errorf("proxy_id must be a token without spaces, commas or parentheses, got %q", p.ProxyID)
+	}
+	if p.DecisionCacheTTL < 0 {
+		return fmt.Errorf("decision_cache_ttl must not be negative, got %v", time.Duration(p.DecisionCacheTTL))
+	}
+	if p.ResolveConcurrency < 0 {
+		return fmt.Errorf("resolve_concurrency must not be negative, got %v", p.ResolveConcurrency)
+	}
+	if p.Maintenance.RetryAfter < 0 {
+		return fmt.Errorf("maintenance.retry_after must not be negative, got %v", time.Duration(p.Maintenance.RetryAfter))
+	}
+	if p.AuditLog.MaxSize < 0 || p.AuditLog.MaxFiles < 0 {
+		return errors.New("audit_log: max_size and max_files must not be negative")
+	}
+	for class, n := range p.AuditLog.Sampling {
+		if StatusClass(class) == 0 {
+			return fmt.Errorf("audit_log: sampling: unknown status class %q, want 1xx to 5xx", class)
+		}
+		if n < 0 {
+			return fmt.Errorf("audit_log: sampling of %v must not be negative, got %v", class, n)
+		}
+	}
+	if err := p.AuditLog.Syslog.validate(); err != nil {
+		return err
+	}
+	if p.MaxForwardedFor < 0 {
+		return fmt.Errorf("max_x_forwarded_for must not be negative, got %v", p.MaxForwardedFor)
+	}
+	switch p.ForwardedForOverflow {
+	case ForwardedForReject, ForwardedForTruncate:
+	default:
+		return fmt.Errorf("unsupported x_forwarded_for_overflow %q", p.ForwardedForOverflow)
+	}
+	if p.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("response_header_timeout must not be negative, got %v", time.Duration(p.ResponseHeaderTimeout))
+	}
+	if p.MaxRequestDuration < 0 {
+		return fmt.Errorf("max_request_duration must not be negative, got %v", time.Duration(p.MaxRequestDuration))
+	}
+	if p.DebugLogSampling < 0 {
+		return fmt.Errorf("debug_log_sampling must not be negative, got %v", p.DebugLogSampling)
+	}
+	if p.CopyBufferSize < 0 {
+		return fmt.Errorf("copy_buffer_size must not be negative, got %v", p.CopyBufferSize)
+	}
+	if err := p.Pool.validate(); err != nil {
+		return err
+	}
+	if err := p.Retry.validate(); err != nil {
+		return err
+	}
+	if err := p.LoadShedding.validate(); err != nil {
+		return err
+	}
+	if err := p.IdleSweep.validate(); err != nil {
+		return err
+	}
+	if err := p.Warmup.validate(); err != nil {
+		return err
+	}
+	if err := p.CircuitBreaker.validate(); err != nil {
+		return err
+	}
+	if err := p.TCP.validate(); err != nil {
+		return err
+	}
+	for _, port := range p.BlockedPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("blocked_ports: invalid port %v", port)
+		}
+	}
+	for _, port := range p.ConnectPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("connect_ports: invalid port %v", port)
+		}
+	}
+	for _, bi := range p.BodyInspectors {
+		if err := bi.validate(); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool, len(p.Rules))
+	for i := range p.Rules {
+		name := p.Rules[i].Name
+		switch {
+		case name == "":
+			return fmt.Errorf("rules[%d]: name must be set", i)
+		case slices.Contains(reservedRuleNames, name):
+			return fmt.Errorf("rule %q: the name is reserved for metrics of requests not proxied by a rule", name)
+		case names[name]:
+			return fmt.Errorf("rule %q: names must be unique", name)
+		}
+		names[name] = true
+		if err := p.Rules[i].validate(p.ProxyAuth.Enabled(), p.JWT.Enabled()); err != nil {
+			return fmt.Errorf("rule %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// reservedRuleNames label the default route and requests matched to no rule in metrics and stats.
+// Rule names key circuit breakers, concurrency limits, stats and maintenance as well, so they must be unique.
+var reservedRuleNames = []string{"default", "none"}
+
+// HeaderLimits bounds the request headers forwarded to a rule's upstream. Zero means unlimited.
+type HeaderLimits struct {
+	MaxCount int `json:"max_count"` // header lines, counting every value
+	MaxBytes int `json:"max_bytes"` // total size of the header lines as sent on the wire
+}
+
+// Exceeded reports which limit header exceeds, or "" when it is within both.
+func (l HeaderLimits) Exceeded(header http.Header) string {
+	if l.MaxCount == 0 && l.MaxBytes == 0 {
+		return ""
+	}
+	count, size := 0, 0
+	for name, values := range header {
+		for _, v := range values {
+			count++
+			size += len(name) + len(v) + len(": \r\n")
+		}
+	}
+	switch {
+	case l.MaxCount > 0 && count > l.MaxCount:
+		return "max_count"
+	case l.MaxBytes > 0 && size > l.MaxBytes:
+		return "max_bytes"
+	}
+	return ""
+}
+
+// requiredRequestHeaders are forwarded whatever allowed_request_headers lists, as the request body or its
+// framing cannot be understood without them.
+var requiredRequestHeaders = []string{"Content-Type", "Content-Encoding", "Content-Length", "Te"}
+
+// FilterRequestHeaders removes the headers not in AllowedRequestHeaders from header and returns their names, sorted.
+// It keeps every header when AllowedRequestHeaders is empty.
+func (r *Rule) FilterRequestHeaders(header http.Header) []string {
+	if len(r.AllowedRequestHeaders) == 0 {
+		return nil
+	}
+	var dropped []string
+	for name := range header {
+		if !slices.Contains(r.AllowedRequestHeaders, name) && !slices.Contains(requiredRequestHeaders, name) {
+			dropped = append(dropped, name)
+			delete(header, name)
+		}
+	}
+	slices.Sort(dropped)
+	return dropped
+}
+
+func (r *Rule) validate(authEnabled, jwtEnabled bool) error {
+	switch r.ProxyType {
+	case ProxyTypeSOCKS5, ProxyTypeDirect, ProxyTypeDeny:
+	default:
+		return fmt.Errorf("unsupported proxy_type %q", r.ProxyType)
+	}
+	switch r.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("unsupported log_level %q", r.LogLevel)
+	}
+	for _, ep := range r.Endpoints {
+		if err := ep.validate(); err != nil {
+			return err
+		}
+	}
+	if err := r.Pool.validate(); err != nil {
+		return err
+	}
+	if err := r.Retry.validate(); err != nil {
+		return err
+	}
+	if err := r.Concurrency.validate(); err != nil {
+		return err
+	}
+	if len(r.Users) > 0 && !authEnabled {
+		return errors.New("users requires proxy_auth")
+	}
+	if len(r.JWTClaims) > 0 && !jwtEnabled {
+		return errors.New("jwt_claims requires jwt")
+	}
+	if r.HeaderLimits.MaxCount < 0 || r.HeaderLimits.MaxBytes < 0 {
+		return errors.New("header_limits must not be negative")
+	}
+	for i, name := range r.HeaderOrder {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("header_order: invalid header name %q", name)
+		}
+		if slices.Contains(r.HeaderOrder[:i], name) {
+			return fmt.Errorf("header_order: %q is listed twice", name)
+		}
+	}
+	for _, name := range r.AllowedRequestHeaders {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("allowed_request_headers: invalid header name %q", name)
+		}
+	}
+	if r.ResponseHeaderTimeout != nil && *r.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("response_header_timeout must not be negative, got %v", time.Duration(*r.ResponseHeaderTimeout))
+	}
+	if r.SourceIP != "" {
+		if err := validateLocalIP(r.SourceIP); err != nil {
+			return fmt.Errorf("source_ip: %w", err)
+		}
+	}
+	switch r.Network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("network must be tcp, tcp4 or tcp6, got %q", r.Network)
+	}
+	return nil
+}
+
+// validateLocalIP checks that ip is assigned to one of this host's interfaces.
+func validateLocalIP(s string) error {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return fmt.Errorf("invalid IP %q", s)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v is not a local address", ip)
+}
+
+// OverrideListenAddr makes the proxy listen on addr only, in place of host/port and listen_addrs.
+func (p *Profile) OverrideListenAddr(addr string) error {
+	if err := validateListenAddr(addr); err != nil {
+		return err
+	}
+	p.ServerHost, p.ServerPort, _ = net.SplitHostPort(addr)
+	p.ListenAddrs = nil
+	return nil
+}
+
+// sharesPort reports whether listen addresses a and b would claim the same port, counting an empty or unspecified host as any.
+func sharesPort(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB {
+		return false
+	}
+	wildcard := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || ip != nil && ip.IsUnspecified()
+	}
+	return hostA == hostB || wildcard(hostA) || wildcard(hostB)
+}
+
+// isLoopbackAddr reports whether the listen address addr only accepts connections from the local host.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func validateListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid listen address %q: bad port %q", addr, port)
+	}
+	return nil
 }
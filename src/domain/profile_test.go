@@ -0,0 +1,26 @@
+package domain
+
+import "testing"
+
+func TestAdminTokenRequired(t *testing.T) {
+	tests := []struct {
+		addr  string
+		token Secret
+		ok    bool
+	}{
+		{addr: "127.0.0.1:9090", ok: true},
+		{addr: "[::1]:9090", ok: true},
+		{addr: "localhost:9090", ok: true},
+		{addr: ":9090"},
+		{addr: "0.0.0.0:9090"},
+		{addr: "192.0.2.1:9090"},
+		{addr: "admin.example:9090"},
+		{addr: "0.0.0.0:9090", token: "change-me", ok: true},
+	}
+	for _, tt := range tests {
+		p := &Profile{ListenAddrs: []string{"127.0.0.1:8080"}, Admin: Admin{Addr: tt.addr, Token: tt.token}}
+		if err := p.Prepare(); (err == nil) != tt.ok {
+			t.Errorf("admin addr %q, token set %v: got error %v, want ok %v", tt.addr, tt.token != "", err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package domain
+
+import "encoding/json"
+
+// Secret is a string that is redacted when formatted or encoded as JSON, so credentials never end up in logs or admin responses.
+type Secret string
+
+const redacted = "REDACTED"
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// MarshalJSON encodes s redacted, leaving an unset secret empty so it still shows as unset.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
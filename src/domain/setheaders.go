@@ -0,0 +1,73 @@
+package domain
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// SetHeaders maps request header names to the value they are set to on requests sent upstream, replacing what the client sent.
+// On a rule, the entries extend and override those of the profile, and an empty value leaves a profile header unset for the rule.
+// Values are secrets, as they often carry API keys.
+type SetHeaders map[string]Secret
+
+// headers the proxy derives from the request itself, which set_headers would corrupt
+var reservedSetHeaders = []string{"Host", "Content-Length", "Transfer-Encoding", "Connection", "Proxy-Connection", "Keep-Alive", "Te", "Upgrade"}
+
+// prepare returns h with canonical names, after checking every entry. Empty values are only allowed on rules.
+func (h SetHeaders) prepare(onRule bool) (SetHeaders, error) {
+	if h == nil {
+		return nil, nil
+	}
+	prepared := make(SetHeaders, len(h))
+	for name, value := range h {
+		canonical := http.CanonicalHeaderKey(name)
+		switch {
+		case name == "" || strings.ContainsAny(name, " \t\r\n:"):
+			return nil, fmt.Errorf("set_headers: invalid header name %q", name)
+		case slices.Contains(reservedSetHeaders, canonical):
+			return nil, fmt.Errorf("set_headers: %v cannot be set", canonical)
+		case strings.ContainsAny(string(value), "\r\n\x00"):
+			return nil, fmt.Errorf("set_headers: the value of %v contains a line break", canonical)
+		case value == "" && !onRule:
+			return nil, fmt.Errorf("set_headers: %v has no value", canonical)
+		}
+		if _, dup := prepared[canonical]; dup {
+			return nil, fmt.Errorf("set_headers: %v is listed twice", canonical)
+		}
+		prepared[canonical] = value
+	}
+	return prepared, nil
+}
+
+// mergeSetHeaders returns the headers set on requests of a rule with set_headers rule, under a profile with global,
+// sorted by name.
+func mergeSetHeaders(global, rule SetHeaders) []HeaderField {
+	merged := maps.Clone(global)
+	if merged == nil {
+		merged = SetHeaders{}
+	}
+	for name, value := range rule {
+		if value == "" {
+			delete(merged, name)
+		} else {
+			merged[name] = value
+		}
+	}
+	fields := make([]HeaderField, 0, len(merged))
+	for _, name := range slices.Sorted(maps.Keys(merged)) {
+		fields = append(fields, HeaderField{Name: name, Value: string(merged[name])})
+	}
+	return fields
+}
+
+// SetHeadersFor returns the headers set on requests routed to rule, the rule's set_headers taking precedence
+// over the profile's. A nil rule stands for the default direct route.
+func (p *Profile) SetHeadersFor(rule *Rule) []HeaderField {
+	if rule != nil {
+		return rule.setHeaders
+	}
+	return p.setHeaders
+}
@@ -0,0 +1,263 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Pool holds the connection pool limits of upstream transports. Unset fields inherit
+// from the profile, then from DefaultPool; zero means unlimited, as in http.Transport.
+type Pool struct {
+	MaxIdleConns        *int `json:"max_idle_conns"`
+	MaxIdleConnsPerHost *int `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     *int `json:"max_conns_per_host"`
+
+	IdleConnTimeout *Duration `json:"idle_conn_timeout"` // idle connections are closed after it
+	MaxConnLifetime *Duration `json:"max_conn_lifetime"` // age after which the pool is replaced, so no connection is reused past it
+}
+
+func intPtr(v int) *int { return &v }
+
+var DefaultPool = Pool{
+	MaxIdleConns:        intPtr(100),
+	MaxIdleConnsPerHost: intPtr(16),
+	MaxConnsPerHost:     intPtr(0),
+	IdleConnTimeout:     durationPtr(90 * time.Second), // as in http.DefaultTransport
+	MaxConnLifetime:     durationPtr(0),
+}
+
+// inherit fills fields unset in p from parent.
+func (p Pool) inherit(parent Pool) Pool {
+	if p.MaxIdleConns == nil {
+		p.MaxIdleConns = parent.MaxIdleConns
+	}
+	if p.MaxIdleConnsPerHost == nil {
+		p.MaxIdleConnsPerHost = parent.MaxIdleConnsPerHost
+	}
+	if p.MaxConnsPerHost == nil {
+		p.MaxConnsPerHost = parent.MaxConnsPerHost
+	}
+	if p.IdleConnTimeout == nil {
+		p.IdleConnTimeout = parent.IdleConnTimeout
+	}
+	if p.MaxConnLifetime == nil {
+		p.MaxConnLifetime = parent.MaxConnLifetime
+	}
+	return p
+}
+
+func (p Pool) validate() error {
+	for name, v := range map[string]*int{
+		"max_idle_conns":          p.MaxIdleConns,
+		"max_idle_conns_per_host": p.MaxIdleConnsPerHost,
+		"max_conns_per_host":      p.MaxConnsPerHost,
+	} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("pool: %v must not be negative", name)
+		}
+	}
+	for name, v := range map[string]*Duration{
+		"idle_conn_timeout": p.IdleConnTimeout,
+		"max_conn_lifetime": p.MaxConnLifetime,
+	} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("pool: %v must not be negative, got %v", name, time.Duration(*v))
+		}
+	}
+	return nil
+}
+
+// Retry is the policy for resending a request after a transport error, or a 429 or 503 response with Retry-After. Unset fields
+// inherit from the profile, then from DefaultRetry.
+type Retry struct {
+	Attempts *int      `json:"attempts"` // retries after the first attempt, 0 disables retrying
+	Backoff  *Duration `json:"backoff"`  // fixed delay between attempts
+	// longest Retry-After of a 429 or 503 response waited before resending; longer ones are passed to the client
+	MaxRetryAfter *Duration `json:"max_retry_after"`
+	// the upstream tolerates replays, so non-idempotent methods such as POST are retried too
+	Idempotent *bool `json:"idempotent"`
+}
+
+var DefaultRetry = Retry{
+	Attempts:      intPtr(0),
+	Backoff:       durationPtr(100 * time.Millisecond),
+	MaxRetryAfter: durationPtr(10 * time.Second),
+	Idempotent:    boolPtr(false),
+}
+
+// DefaultMaxBufferedBody is the largest request body buffered for retries unless the profile sets max_buffered_body.
+const DefaultMaxBufferedBody = 64 << 10
+
+// DefaultCopyBufferSize is the buffer size used to stream response bodies and tunnels unless the profile sets copy_buffer_size.
+const DefaultCopyBufferSize = 32 << 10
+
+func durationPtr(d time.Duration) *Duration { return (*Duration)(&d) }
+
+func boolPtr(v bool) *bool { return &v }
+
+// inherit fills fields unset in r from parent.
+func (r Retry) inherit(parent Retry) Retry {
+	if r.Attempts == nil {
+		r.Attempts = parent.Attempts
+	}
+	if r.Backoff == nil {
+		r.Backoff = parent.Backoff
+	}
+	if r.MaxRetryAfter == nil {
+		r.MaxRetryAfter = parent.MaxRetryAfter
+	}
+	if r.Idempotent == nil {
+		r.Idempotent = parent.Idempotent
+	}
+	return r
+}
+
+func (r Retry) validate() error {
+	if r.Attempts != nil && *r.Attempts < 0 {
+		return fmt.Errorf("retry: attempts must not be negative")
+	}
+	if r.Backoff != nil && *r.Backoff < 0 {
+		return fmt.Errorf("retry: backoff must not be negative")
+	}
+	if r.MaxRetryAfter != nil && *r.MaxRetryAfter < 0 {
+		return fmt.Errorf("retry: max_retry_after must not be negative")
+	}
+	return nil
+}
+
+// Allows reports whether a request with method may be resent under the policy.
+func (r Retry) Allows(method string) bool {
+	if *r.Attempts == 0 {
+		return false
+	}
+	if *r.Idempotent {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Warmup keeps connections to SOCKS servers open ahead of requests. It is disabled when Connections is 0.
+type Warmup struct {
+	Connections int      `json:"connections"` // spare connections kept per SOCKS endpoint
+	Concurrency int      `json:"concurrency"` // dials in flight at once, 4 by default
+	Interval    Duration `json:"interval"`    // how often spares are refilled and replaced, 30s by default
+}
+
+func (w *Warmup) setDefaults() {
+	if w.Concurrency == 0 {
+		w.Concurrency = 4
+	}
+	if w.Interval == 0 {
+		w.Interval = Duration(30 * time.Second)
+	}
+}
+
+func (w Warmup) validate() error {
+	if w.Connections < 0 || w.Concurrency < 0 || w.Interval < 0 {
+		return errors.New("warmup: connections, concurrency and interval must not be negative")
+	}
+	return nil
+}
+
+// LoadShedding answers new requests with 503 once more than HighWatermark client connections are open,
+// until fewer than LowWatermark are. It is disabled when HighWatermark is 0.
+type LoadShedding struct {
+	HighWatermark int `json:"high_watermark"`
+	LowWatermark  int `json:"low_watermark"` // 90% of HighWatermark by default, at least 1
+}
+
+func (l *LoadShedding) setDefaults() {
+	if l.LowWatermark == 0 && l.HighWatermark > 0 {
+		// rounding down to 0 would keep shedding forever, as the count can never drop below it
+		l.LowWatermark = max(l.HighWatermark*9/10, 1)
+	}
+}
+
+func (l LoadShedding) validate() error {
+	if l.HighWatermark < 0 || l.LowWatermark < 0 {
+		return errors.New("load_shedding: high_watermark and low_watermark must not be negative")
+	}
+	if l.LowWatermark > l.HighWatermark {
+		return fmt.Errorf("load_shedding: low_watermark %v must not exceed high_watermark %v", l.LowWatermark, l.HighWatermark)
+	}
+	return nil
+}
+
+// IdleSweep closes the idle connections of transports that served at most MaxRequests requests since the previous sweep,
+// freeing sockets to rarely used upstreams before idle_conn_timeout would. It is disabled when Interval is 0.
+type IdleSweep struct {
+	Interval    Duration `json:"interval"`
+	MaxRequests int      `json:"max_requests"` // 0 by default: only transports no request used
+}
+
+func (w IdleSweep) validate() error {
+	if w.Interval < 0 || w.MaxRequests < 0 {
+		return errors.New("idle_sweep: interval and max_requests must not be negative")
+	}
+	return nil
+}
+
+// CircuitBreaker takes a rule whose upstream keeps failing out of matching, so requests fall through to the next
+// matching rule. It is disabled when Failures is 0.
+type CircuitBreaker struct {
+	Failures int      `json:"failures"` // consecutive upstream errors opening the circuit
+	Cooldown Duration `json:"cooldown"` // how long the circuit stays open before a trial request, 30s by default
+}
+
+// Enabled reports whether rules are taken out of matching on upstream errors.
+func (c CircuitBreaker) Enabled() bool {
+	return c.Failures > 0
+}
+
+func (c *CircuitBreaker) setDefaults() {
+	if c.Cooldown == 0 {
+		c.Cooldown = Duration(30 * time.Second)
+	}
+}
+
+func (c CircuitBreaker) validate() error {
+	if c.Failures < 0 || c.Cooldown < 0 {
+		return errors.New("circuit_breaker: failures and cooldown must not be negative")
+	}
+	return nil
+}
+
+// Concurrency caps the requests and tunnels a rule has open to its upstream at once. It is disabled when Max is 0.
+type Concurrency struct {
+	Max int `json:"max"`
+	// how long a request over the cap waits for a slot before getting 503; 0 answers 503 at once
+	QueueTimeout Duration `json:"queue_timeout"`
+}
+
+func (c Concurrency) validate() error {
+	if c.Max < 0 || c.QueueTimeout < 0 {
+		return errors.New("concurrency: max and queue_timeout must not be negative")
+	}
+	return nil
+}
+
+// TCPOptions tune the TCP connections of tunnels and to upstreams. Zero buffer sizes keep the OS defaults.
+type TCPOptions struct {
+	NoDelay     *bool `json:"no_delay"`     // send small writes at once instead of coalescing them, true by default as in Go
+	ReadBuffer  int   `json:"read_buffer"`  // SO_RCVBUF in bytes
+	WriteBuffer int   `json:"write_buffer"` // SO_SNDBUF in bytes
+}
+
+func (t *TCPOptions) setDefaults() {
+	if t.NoDelay == nil {
+		t.NoDelay = boolPtr(true)
+	}
+}
+
+func (t TCPOptions) validate() error {
+	if t.ReadBuffer < 0 || t.WriteBuffer < 0 {
+		return errors.New("tcp: read_buffer and write_buffer must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// ProfileVersion is the schema version of profiles written for this release.
+const ProfileVersion = 2
+
+// migrations[i] upgrades a profile document from version i+1 to i+2.
+var migrations = []func(doc map[string]any){
+	// version 2 passes upstream redirects to the client; version 1 followed them
+	func(doc map[string]any) {
+		if _, ok := doc["follow_redirects"]; !ok {
+			doc["follow_redirects"] = true
+		}
+	},
+}
+
+// MigrateProfile upgrades a JSON profile to ProfileVersion so it keeps its meaning when decoded, and returns the version
+// it was written for. Profiles without a version predate versioning and are version 1; versions newer than this release are rejected.
+func MigrateProfile(data []byte) ([]byte, int, error) {
+	var head struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, 0, err
+	}
+	if head.Version == 0 {
+		head.Version = 1
+	}
+	switch {
+	case head.Version == ProfileVersion:
+		return data, head.Version, nil
+	case head.Version > ProfileVersion:
+		return nil, 0, fmt.Errorf("profile version %v is newer than the supported version %v, upgrade h2s-proxy", head.Version, ProfileVersion)
+	case head.Version < 0:
+		return nil, 0, fmt.Errorf("invalid profile version %v", head.Version)
+	}
+	// numbers kept as written, float64 would round integers above 2^53
+	var doc map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, 0, err
+	}
+	for _, migrate := range migrations[head.Version-1:] {
+		migrate(doc)
+	}
+	doc["version"] = ProfileVersion
+	data, err := json.Marshal(doc)
+	return data, head.Version, err
+}
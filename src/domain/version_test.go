@@ -0,0 +1,50 @@
+package domain
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMigrateProfile(t *testing.T) {
+	tests := []struct {
+		name            string
+		profile         string
+		from            int
+		followRedirects bool
+		maxBufferedBody int64
+		wantErr         bool
+	}{
+		{name: "unversioned is version 1", profile: `{}`, from: 1, followRedirects: true},
+		{name: "version 1", profile: `{"version": 1}`, from: 1, followRedirects: true},
+		{name: "version 1 keeps follow_redirects", profile: `{"version": 1, "follow_redirects": false}`, from: 1},
+		{name: "version 1 keeps large integers", profile: `{"max_buffered_body": 9007199254740993}`, from: 1, followRedirects: true, maxBufferedBody: 9007199254740993},
+		{name: "current", profile: `{"version": 2}`, from: 2},
+		{name: "future", profile: `{"version": 3}`, wantErr: true},
+		{name: "negative", profile: `{"version": -1}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, from, err := MigrateProfile([]byte(tt.profile))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got no error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var p Profile
+			if err := json.Unmarshal(data, &p); err != nil {
+				t.Fatal(err)
+			}
+			if from != tt.from || p.Version != ProfileVersion || p.FollowRedirects != tt.followRedirects {
+				t.Errorf("got from %v, version %v, follow_redirects %v; want from %v, version %v, follow_redirects %v",
+					from, p.Version, p.FollowRedirects, tt.from, ProfileVersion, tt.followRedirects)
+			}
+			if p.MaxBufferedBody != tt.maxBufferedBody {
+				t.Errorf("max_buffered_body %v, want %v", p.MaxBufferedBody, tt.maxBufferedBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package domain
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	// time zones of active_windows must load the same on hosts without a zoneinfo database, e.g. scratch containers
+	_ "time/tzdata"
+)
+
+// ActiveWindow is a weekly time range in which a rule applies, e.g. {"days": ["sat", "sun"], "start": "00:00", "end": "24:00"}.
+// A window ending before it starts runs past midnight into the next day; Days are the days it starts on.
+type ActiveWindow struct {
+	Days     []string `json:"days"`     // mon to sun, every day when empty
+	Start    string   `json:"start"`    // HH:MM
+	End      string   `json:"end"`      // HH:MM, up to 24:00
+	Timezone string   `json:"timezone"` // IANA name such as Europe/Berlin, UTC by default
+
+	loc        *time.Location
+	days       [7]bool // by time.Weekday
+	start, end int     // minutes since midnight
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (w *ActiveWindow) compile() error {
+	var err error
+	if w.loc, err = time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("timezone: %w", err)
+	}
+	w.days = [7]bool{}
+	for _, d := range w.Days {
+		i := slices.Index(weekdays, strings.ToLower(d))
+		if i < 0 {
+			return fmt.Errorf("days: %q is not one of mon, tue, wed, thu, fri, sat and sun", d)
+		}
+		w.days[i] = true
+	}
+	if len(w.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	if w.start, err = parseClock(w.Start); err != nil || w.start == 24*60 {
+		return fmt.Errorf("start must be a time of day from 00:00 to 23:59, got %q", w.Start)
+	}
+	if w.end, err = parseClock(w.End); err != nil {
+		return fmt.Errorf("end must be a time of day from 00:00 to 24:00, got %q", w.End)
+	}
+	if w.start == w.end {
+		return fmt.Errorf("start and end must differ, got %q for both", w.Start)
+	}
+	return nil
+}
+
+// parseClock returns the minutes since midnight of an HH:MM time of day, allowing 24:00.
+func parseClock(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil || len(s) != len("15:04") {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t falls in the window, in its time zone.
+func (w *ActiveWindow) Contains(t time.Time) bool {
+	t = t.In(w.loc)
+	minute, day := t.Hour()*60+t.Minute(), t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// past midnight: the evening of a listed day, or the morning after one
+	return w.days[day] && minute >= w.start || w.days[(day+6)%7] && minute < w.end
+}
+
+// matchWindows reports whether t is in one of the active windows of the rule, or the rule has none.
+func (r *Rule) matchWindows(t time.Time) bool {
+	if len(r.ActiveWindows) == 0 {
+		return true
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return slices.ContainsFunc(r.ActiveWindows, func(w ActiveWindow) bool { return w.Contains(t) })
+}
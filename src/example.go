@@ -0,0 +1,22 @@
+package main
+
+import (
+	_ "embed"
+	"os"
+)
+
+//go:embed example/example-profile.json
+var exampleProfile []byte
+
+// writeExampleProfile writes the example profile to path for --init. An existing file is never overwritten.
+func writeExampleProfile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(exampleProfile); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// isGRPC reports whether req is a gRPC call. gRPC needs HTTP/2 to the upstream,
+// unbuffered streaming in both directions and trailers.
+func isGRPC(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+"))
+}
+
+// acceptsTrailers reports whether the client sent "TE: trailers". TE is hop-by-hop, but since the proxy
+// forwards trailers it can accept them from the upstream on the client's behalf. gRPC servers require it.
+func acceptsTrailers(header http.Header) bool {
+	for _, v := range header.Values("TE") {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copyTrailer announces the upstream trailers to the client. It must be called after the body was copied.
+func copyTrailer(wr http.ResponseWriter, trailer http.Header) {
+	for k, vv := range trailer {
+		wr.Header()[http.TrailerPrefix+k] = vv
+	}
+}
+
+// flushWriter flushes after every write, so streamed messages reach the client as soon as they arrive.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.f.Flush()
+	return n, err
+}
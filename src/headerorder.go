@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// orderedTransport sends requests over HTTP/1.1 with their headers in a configured order, for rules with header_order.
+// http.Transport offers no hook for this: it always writes headers sorted by name. Each request gets its own connection,
+// closed with the response body, as reusing connections would mean reimplementing the pool of http.Transport.
+type orderedTransport struct {
+	tr    *http.Transport // provides the dialer, TLS settings and response header timeout of the route
+	order []string        // canonical header names; Host is sent first unless listed
+}
+
+func (t orderedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := req.Body
+	if req.GetBody != nil {
+		// retries send the same request again, and GetBody is what rewinds its buffered body
+		if b, err := req.GetBody(); err == nil {
+			body = b
+		}
+	}
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	ctx := req.Context()
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), defaultPort(req.URL.Scheme))
+	}
+	conn, err := t.dial(ctx, req.URL.Scheme, addr, req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	fail := func(err error) (*http.Response, error) {
+		stop()
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if err := writeOrdered(conn, req, body, t.order); err != nil {
+		return fail(err)
+	}
+	if d := t.tr.ResponseHeaderTimeout; d > 0 {
+		conn.SetReadDeadline(time.Now().Add(d))
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	for err == nil && res.StatusCode >= 100 && res.StatusCode < 200 && res.StatusCode != http.StatusSwitchingProtocols {
+		// informational responses such as 100 Continue precede the final one
+		res, err = http.ReadResponse(br, req)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	res.Body = connClosingBody{ReadCloser: res.Body, conn: conn, stop: stop}
+	return res, nil
+}
+
+// dial connects to addr through the route of t, completing the TLS handshake for https.
+func (t orderedTransport) dial(ctx context.Context, scheme, addr, host string) (net.Conn, error) {
+	if scheme == "https" && t.tr.DialTLSContext != nil {
+		return t.tr.DialTLSContext(ctx, "tcp", addr)
+	}
+	conn, err := t.tr.DialContext(ctx, "tcp", addr)
+	if err != nil || scheme != "https" {
+		return conn, err
+	}
+	cfg := &tls.Config{}
+	if t.tr.TLSClientConfig != nil {
+		cfg = t.tr.TLSClientConfig.Clone()
+	}
+	cfg.ServerName = host
+	cfg.NextProtos = []string{"http/1.1"}
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// writeOrdered writes req with body to w: the headers named in order first, in that order, then the others sorted by name.
+func writeOrdered(w io.Writer, req *http.Request, body io.Reader, order []string) error {
+	header := req.Header.Clone()
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	header.Set("Host", host)
+	header.Set("Connection", "close")
+	header.Del("Transfer-Encoding")
+	chunked := false
+	switch {
+	case body == nil || body == http.NoBody:
+		header.Del("Content-Length")
+		if req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodPatch {
+			// as http.Transport does, so origins do not wait for a body
+			header.Set("Content-Length", "0")
+		}
+	case req.ContentLength >= 0:
+		header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	default:
+		header.Del("Content-Length")
+		header.Set("Transfer-Encoding", "chunked")
+		chunked = true
+	}
+
+	names := slices.Clone(order)
+	if !slices.Contains(names, "Host") {
+		names = append([]string{"Host"}, names...)
+	}
+	var rest []string
+	for name := range header {
+		if !slices.Contains(names, name) {
+			rest = append(rest, name)
+		}
+	}
+	slices.Sort(rest)
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(req.Method + " " + req.URL.RequestURI() + " HTTP/1.1\r\n")
+	sanitize := strings.NewReplacer("\r", " ", "\n", " ")
+	for _, name := range append(names, rest...) {
+		for _, v := range header[name] {
+			bw.WriteString(name + ": " + sanitize.Replace(v) + "\r\n")
+		}
+	}
+	bw.WriteString("\r\n")
+	switch {
+	case chunked:
+		cw := httputil.NewChunkedWriter(bw)
+		if _, err := io.Copy(cw, body); err != nil {
+			return err
+		}
+		cw.Close()
+		bw.WriteString("\r\n")
+	case req.ContentLength > 0:
+		if _, err := io.CopyN(bw, body, req.ContentLength); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// connClosingBody closes the connection of an orderedTransport response along with its body.
+type connClosingBody struct {
+	io.ReadCloser
+	conn net.Conn
+	stop func() bool
+}
+
+func (b connClosingBody) Close() error {
+	b.stop()
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
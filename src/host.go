@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// destination is the validated authority of a proxied request or CONNECT tunnel.
+type destination struct {
+	host         string // lowercase name without trailing dot, or an IP address
+	port         string
+	explicitPort bool // the client gave the port, rather than it coming from the scheme
+}
+
+// parseDestination validates and normalizes authority, a host with an optional port, so that matching and dialing
+// see one spelling of each host. defaultPort is used when the port is missing; an empty defaultPort makes it required.
+func parseDestination(authority, defaultPort string) (destination, error) {
+	if authority == "" {
+		return destination{}, errors.New("empty host")
+	}
+	d := destination{explicitPort: true}
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		if defaultPort == "" {
+			return destination{}, err
+		}
+		host, port = authority, defaultPort
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+		d.explicitPort = false
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return destination{}, fmt.Errorf("invalid port %q", port)
+	}
+	d.port = port
+	if strings.Contains(host, "%") {
+		// net/url decodes absolute request URLs, but CONNECT and h2c authorities arrive as sent
+		if host, err = url.PathUnescape(host); err != nil {
+			return destination{}, fmt.Errorf("invalid host: %w", err)
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		d.host = ip.String()
+		return d, nil
+	}
+	if strings.Contains(host, ":") {
+		return destination{}, fmt.Errorf("invalid IP address %q", host)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if err := validateHostname(host); err != nil {
+		return destination{}, err
+	}
+	d.host = host
+	return d, nil
+}
+
+// validateHostname accepts names of letters, digits, '-' and '_' in dot-separated labels of at most 63 bytes.
+// '_' is not allowed by RFC 1123 but is common in internal names.
+func validateHostname(host string) error {
+	if host == "" || len(host) > 253 {
+		return fmt.Errorf("invalid host name %q", host)
+	}
+	for label := range strings.SplitSeq(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid host name %q", host)
+		}
+		for _, c := range []byte(label) {
+			if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid character %q in host name", c)
+			}
+		}
+	}
+	return nil
+}
+
+// authority formats d back as host[:port], keeping the port only when the client gave it.
+func (d destination) authority() string {
+	if d.explicitPort {
+		return net.JoinHostPort(d.host, d.port)
+	}
+	if strings.Contains(d.host, ":") {
+		return "[" + d.host + "]"
+	}
+	return d.host
+}
+
+// defaultPort returns the port implied by the scheme of a proxied URL.
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		name        string
+		authority   string
+		defaultPort string // "" for CONNECT, where the port is required
+		host, port  string
+		authorityOf string // the authority the request is sent with
+	}{
+		{name: "lowercased", authority: "API.Example.COM:8080", defaultPort: "80", host: "api.example.com", port: "8080", authorityOf: "api.example.com:8080"},
+		{name: "trailing dot", authority: "example.com.", defaultPort: "80", host: "example.com", port: "80", authorityOf: "example.com"},
+		{name: "percent-encoded", authority: "ex%61mple.com:443", defaultPort: "", host: "example.com", port: "443", authorityOf: "example.com:443"},
+		{name: "underscore", authority: "db_1.corp", defaultPort: "80", host: "db_1.corp", port: "80", authorityOf: "db_1.corp"},
+		{name: "IPv4", authority: "10.0.0.1:22", defaultPort: "", host: "10.0.0.1", port: "22", authorityOf: "10.0.0.1:22"},
+		{name: "bracketed IPv6 with default port", authority: "[2001:DB8::1]", defaultPort: "443", host: "2001:db8::1", port: "443", authorityOf: "[2001:db8::1]"},
+		{name: "bracketed IPv6 with port", authority: "[::1]:8443", defaultPort: "", host: "::1", port: "8443", authorityOf: "[::1]:8443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := parseDestination(tt.authority, tt.defaultPort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.host != tt.host || d.port != tt.port || d.authority() != tt.authorityOf {
+				t.Errorf("got host %q, port %q, authority %q; want %q, %q, %q", d.host, d.port, d.authority(), tt.host, tt.port, tt.authorityOf)
+			}
+		})
+	}
+}
+
+func TestParseDestinationMalformed(t *testing.T) {
+	tests := []struct {
+		name        string
+		authority   string
+		defaultPort string
+	}{
+		{name: "empty", authority: "", defaultPort: "80"},
+		{name: "empty host", authority: ":8080", defaultPort: "80"},
+		{name: "only a dot", authority: ".", defaultPort: "80"},
+		{name: "non-numeric port", authority: "example.com:http", defaultPort: "80"},
+		{name: "port zero", authority: "example.com:0", defaultPort: "80"},
+		{name: "port out of range", authority: "example.com:65536", defaultPort: "80"},
+		{name: "missing CONNECT port", authority: "example.com", defaultPort: ""},
+		{name: "bracketed IPv6 without CONNECT port", authority: "[2001:db8::1]", defaultPort: ""},
+		{name: "unbracketed IPv6 with port", authority: "2001:db8::1:443", defaultPort: ""},
+		{name: "invalid IPv6", authority: "[2001:db8:::1]:443", defaultPort: ""},
+		{name: "space", authority: "exa mple.com", defaultPort: "80"},
+		{name: "encoded space", authority: "exa%20mple.com:443", defaultPort: ""},
+		{name: "bad escape", authority: "ex%zzample.com:443", defaultPort: ""},
+		{name: "encoded slash", authority: "example.com%2Fevil:443", defaultPort: ""},
+		{name: "userinfo", authority: "user@example.com", defaultPort: "80"},
+		{name: "non-ASCII", authority: "exämple.com", defaultPort: "80"},
+		{name: "empty label", authority: "example..com", defaultPort: "80"},
+		{name: "leading hyphen", authority: "-example.com", defaultPort: "80"},
+		{name: "trailing hyphen", authority: "example-.com", defaultPort: "80"},
+		{name: "label over 63 bytes", authority: strings.Repeat("a", 64) + ".com", defaultPort: "80"},
+		{name: "name over 253 bytes", authority: strings.Repeat(strings.Repeat("a", 63)+".", 4) + "com", defaultPort: "80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d, err := parseDestination(tt.authority, tt.defaultPort); err == nil {
+				t.Errorf("parseDestination(%q) = %+v, want an error", tt.authority, d)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleSweepPollInterval is how often a disabled idle sweep checks whether a reload enabled it.
+const idleSweepPollInterval = time.Minute
+
+// sweepIdleConns runs the idle_sweep janitor until ctx is done, reading its settings from the current profile before each sweep.
+func (s *H2SProxyServer) sweepIdleConns(ctx context.Context) {
+	for {
+		cfg := s.profile.Load().IdleSweep
+		wait := time.Duration(cfg.Interval)
+		if wait == 0 {
+			wait = idleSweepPollInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(wait):
+		}
+		if cfg.Interval == 0 {
+			continue
+		}
+		transports, closed := s.transports.sweepIdle(int64(cfg.MaxRequests))
+		log := s.logger.Debugw
+		if closed > 0 {
+			log = s.logger.Infow
+		}
+		log("swept idle upstream connections", "transports", transports, "closed", closed)
+	}
+}
+
+// sweepIdle closes the idle connections of the transports acquired at most maxRequests times since the previous sweep,
+// returning how many transports were swept and how many connections were closed.
+func (c *transportCache) sweepIdle(maxRequests int64) (transports int, closed int64) {
+	c.mu.Lock()
+	cached := make([]*cachedTransport, 0, len(c.transports))
+	for _, ct := range c.transports {
+		cached = append(cached, ct)
+	}
+	c.mu.Unlock()
+	for _, ct := range cached {
+		if ct.requests.Swap(0) > maxRequests {
+			continue
+		}
+		before := ct.closed.Load()
+		ct.CloseIdleConnections()
+		transports++
+		closed += ct.closed.Load() - before
+	}
+	return transports, closed
+}
+
+// countClosed wraps dial so that every connection it returns adds one to closed when it is closed.
+// CloseIdleConnections closes connections synchronously, so the difference across a call is what it closed.
+func countClosed(dial dialFunc, closed *atomic.Int64) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &closeCountingConn{Conn: conn, closed: closed}, nil
+	}
+}
+
+type closeCountingConn struct {
+	net.Conn
+	closed *atomic.Int64
+	once   sync.Once
+}
+
+func (c *closeCountingConn) Close() error {
+	c.once.Do(func() { c.closed.Add(1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type inboundConnKey struct{}
+
+// inboundConnIDs numbers inbound connections, so the admin server can show which requests share one.
+var inboundConnIDs atomic.Uint64
+
+// inboundListener wraps accepted connections so slow clients can be observed, and counts them for load shedding.
+type inboundListener struct {
+	net.Listener
+	metrics *metrics
+	shedder *loadShedder
+}
+
+func (l *inboundListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.shedder.opened()
+	return &inboundConn{Conn: c, id: inboundConnIDs.Add(1), metrics: l.metrics, shedder: l.shedder, waitStart: time.Now(), rule: ruleLabelNone}, nil
+}
+
+func withInboundConn(ctx context.Context, c net.Conn) context.Context {
+	if ic, ok := c.(*inboundConn); ok {
+		return context.WithValue(ctx, inboundConnKey{}, ic)
+	}
+	return ctx
+}
+
+func inboundConnFrom(ctx context.Context) (*inboundConn, bool) {
+	ic, ok := ctx.Value(inboundConnKey{}).(*inboundConn)
+	return ic, ok
+}
+
+type inboundConn struct {
+	net.Conn
+	id      uint64
+	metrics *metrics
+	shedder *loadShedder
+
+	// a single HTTP/2 connection carries many requests at once, these tell multiplexing from connection churn
+	streams   atomic.Int64 // requests open
+	requests  atomic.Int64 // requests started
+	protocol  atomic.Pointer[string]
+	closeOnce sync.Once
+
+	mu        sync.Mutex
+	waitStart time.Time // accept time, or the end of the previous request
+	firstByte time.Time // first byte of the current request
+	served    bool      // at least one request completed on this connection
+	rule      string
+	aborting  bool // net/http set a past deadline to cancel its own pending read
+	// h2c: the timing above belongs to no single stream, so it is neither observed nor reset per request
+	multiplexed bool
+}
+
+func (c *inboundConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	if n > 0 && c.firstByte.IsZero() {
+		c.firstByte = time.Now()
+	}
+	var ne net.Error
+	// an idle keep-alive connection timing out is not a slow client
+	idle := c.served && (c.firstByte.IsZero() || c.multiplexed && c.streams.Load() == 0)
+	timedOut := errors.As(err, &ne) && ne.Timeout() && !c.aborting && !idle
+	rule := c.rule
+	c.mu.Unlock()
+	if timedOut {
+		c.metrics.inboundReadTimeouts.inc(rule)
+	}
+	return n, err
+}
+
+func (c *inboundConn) Close() error {
+	c.closeOnce.Do(func() {
+		protocol := ruleLabelNone
+		if p := c.protocol.Load(); p != nil {
+			protocol = *p
+		}
+		c.metrics.inboundConnRequests.observe(float64(c.requests.Load()), protocol)
+		c.shedder.closed()
+	})
+	return c.Conn.Close()
+}
+
+// inboundProtocol is the protocol label of requests: HTTP/2 only reaches the proxy as h2c.
+func inboundProtocol(req *http.Request) string {
+	if req.ProtoMajor == 2 {
+		return "h2c"
+	}
+	return "http/1.1"
+}
+
+func (c *inboundConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.aborting = !t.IsZero() && t.Before(time.Now())
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// inboundRequest records receive timing for a single request on an inboundConn, and what the request transferred.
+type inboundRequest struct {
+	conn  *inboundConn
+	start time.Time
+	body  *eofTimer
+	rule  string
+
+	tunnelIn, tunnelOut int64 // bytes copied each way by a CONNECT tunnel
+	multiplexed         bool  // the connection carries other requests at the same time, i.e. h2c
+
+	tracked *inflightRequest
+}
+
+// startInbound starts tracking req. Receive timing is only recorded on connections accepted by an inboundListener.
+func (s *H2SProxyServer) startInbound(req *http.Request) *inboundRequest {
+	r := &inboundRequest{start: time.Now(), rule: ruleLabelNone}
+	// wrapping NoBody would make the transport send a chunked empty body
+	if req.Body != nil && req.Body != http.NoBody {
+		r.body = &eofTimer{ReadCloser: req.Body}
+		req.Body = r.body
+	}
+	r.conn, _ = inboundConnFrom(req.Context())
+	if c := r.conn; c != nil {
+		protocol := inboundProtocol(req)
+		r.multiplexed = req.ProtoMajor == 2
+		if r.multiplexed {
+			c.mu.Lock()
+			c.multiplexed = true
+			c.mu.Unlock()
+		}
+		c.protocol.CompareAndSwap(nil, &protocol)
+		c.requests.Add(1)
+		c.metrics.inboundStreams.observe(float64(c.streams.Add(1)), protocol)
+	}
+	return r
+}
+
+// bodyBytes returns how much of the request body has been read.
+func (r *inboundRequest) bodyBytes() int64 {
+	if r.body == nil {
+		return 0
+	}
+	return r.body.read.Load()
+}
+
+func (r *inboundRequest) setRule(name string) {
+	r.rule = name
+	if r.tracked != nil {
+		r.tracked.setRule(name)
+	}
+	if r.conn == nil || r.multiplexed {
+		// the rule of one of several concurrent streams is not the rule of their connection
+		return
+	}
+	r.conn.mu.Lock()
+	r.conn.rule = name
+	r.conn.mu.Unlock()
+}
+
+func (r *inboundRequest) finish() {
+	if r.conn == nil {
+		return
+	}
+	c := r.conn
+	c.streams.Add(-1)
+	c.mu.Lock()
+	if r.multiplexed {
+		// resetting the connection would wipe the timing of the streams still open
+		c.served = true
+		c.mu.Unlock()
+		return
+	}
+	waitStart, firstByte := c.waitStart, c.firstByte
+	c.waitStart = time.Now()
+	c.firstByte = time.Time{}
+	c.served = true
+	c.rule = ruleLabelNone
+	c.mu.Unlock()
+
+	if firstByte.IsZero() {
+		return
+	}
+	received := r.start
+	if r.body != nil {
+		eof := r.body.eof.Load()
+		if eof == 0 {
+			// body was never fully read, so the receive time is unknown
+			return
+		}
+		received = time.Unix(0, eof)
+	}
+	c.metrics.inboundTTFB.observe(firstByte.Sub(waitStart).Seconds(), r.rule)
+	c.metrics.inboundReceiveTime.observe(received.Sub(firstByte).Seconds(), r.rule)
+}
+
+// eofTimer records when the body was fully read, and how much was. The transport reads it from its own goroutine.
+type eofTimer struct {
+	io.ReadCloser
+	eof  atomic.Int64
+	read atomic.Int64
+}
+
+func (t *eofTimer) Read(b []byte) (int, error) {
+	n, err := t.ReadCloser.Read(b)
+	t.read.Add(int64(n))
+	if err == io.EOF {
+		t.eof.CompareAndSwap(0, time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// twoRuleProfile routes a.example and b.example through different SOCKS servers.
+const twoRuleProfile = `{
+  "version": 2,
+  "listen_addrs": ["127.0.0.1:0"],
+  "rules": [
+    {"name": "a", "patterns": ["glob:a.example"], "proxy_ip": "10.0.0.1", "port": "1080"},
+    {"name": "b", "patterns": ["glob:b.example"], "proxy_ip": "10.0.0.2", "port": "1080"}
+  ]
+}`
+
+// newStubProxy serves twoRuleProfile in test mode, so every upstream is answered by serveStub with the route it took.
+func newStubProxy(t *testing.T, configure ...func(*http.Server)) (*H2SProxyServer, string) {
+	t.Helper()
+	s, ts := newTestProxy(t, twoRuleProfile, configure...)
+	s.transports.stub = true
+	return s, ts.Listener.Addr().String()
+}
+
+// checkRoute decodes the stub answer in res and checks it took the route of rule through proxyAddr.
+func checkRoute(t *testing.T, res *http.Response, rule, proxyAddr string) {
+	t.Helper()
+	defer res.Body.Close()
+	var got stubUpstream
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding the stub answer (status %v): %v", res.StatusCode, err)
+	}
+	if got.Rule != rule || got.ProxyAddr != proxyAddr {
+		t.Errorf("request for rule %v took rule %q through %q, want %v", rule, got.Rule, got.ProxyAddr, proxyAddr)
+	}
+}
+
+func TestKeepAliveRoutesEachRequest(t *testing.T) {
+	_, addr := newStubProxy(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for _, r := range []struct{ host, rule, proxyAddr string }{
+		{"a.example", "a", "10.0.0.1:1080"},
+		{"b.example", "b", "10.0.0.2:1080"},
+		{"a.example", "a", "10.0.0.1:1080"},
+	} {
+		fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", r.host, r.host)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request for %v on the kept-alive connection: %v", r.host, err)
+		}
+		if res.Close {
+			t.Fatal("the proxy closed the keep-alive connection")
+		}
+		checkRoute(t, res, r.rule, r.proxyAddr)
+	}
+}
+
+func TestH2CRoutesEachStream(t *testing.T) {
+	var mu sync.Mutex
+	var conns []*inboundConn
+	s, addr := newStubProxy(t, func(srv *http.Server) {
+		srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			mu.Lock()
+			conns = append(conns, c.(*inboundConn))
+			mu.Unlock()
+			return withInboundConn(ctx, c)
+		}
+	})
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	defer client.CloseIdleConnections()
+	send := func(host string, body io.Reader) (*http.Response, error) {
+		// h2c clients send the destination as :authority, to the address of the proxy
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/", body)
+		req.Host = host
+		return client.Do(req)
+	}
+	get := func(host string) (*http.Response, error) { return send(host, nil) }
+	res, err := get("a.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoute(t, res, "a", "10.0.0.1:1080")
+
+	// concurrent streams on the same connection, alternating between the rules
+	var wg sync.WaitGroup
+	for i := range 10 {
+		host, rule, proxyAddr := "a.example", "a", "10.0.0.1:1080"
+		if i%2 == 1 {
+			host, rule, proxyAddr = "b.example", "b", "10.0.0.2:1080"
+		}
+		wg.Go(func() {
+			res, err := get(host)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if res.ProtoMajor != 2 {
+				t.Errorf("got %v, want h2c", res.Proto)
+			}
+			checkRoute(t, res, rule, proxyAddr)
+		})
+	}
+	wg.Wait()
+
+	// two streams held open by their unfinished bodies: the connection carries both rules, so neither may label it
+	var bodies []*io.PipeWriter
+	for _, host := range []string{"a.example", "b.example"} {
+		pr, pw := io.Pipe()
+		bodies = append(bodies, pw)
+		wg.Go(func() {
+			if res, err := send(host, pr); err == nil {
+				res.Body.Close()
+			}
+		})
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		routed := 0
+		for _, info := range s.inflight.list() {
+			if info.Rule != ruleLabelNone {
+				routed++
+			}
+		}
+		if routed == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for both streams to be routed")
+		}
+	}
+	mu.Lock()
+	if len(conns) != 1 {
+		t.Errorf("the proxy accepted %v connections, want 1 carrying every stream", len(conns))
+	}
+	c := conns[0]
+	mu.Unlock()
+	c.mu.Lock()
+	rule := c.rule
+	c.mu.Unlock()
+	if rule != ruleLabelNone {
+		t.Errorf("multiplexed connection labeled with rule %q, want %q", rule, ruleLabelNone)
+	}
+	for _, pw := range bodies {
+		pw.Close()
+	}
+	wg.Wait()
+}
+
+func TestH2CStreamKeepsConnectionTiming(t *testing.T) {
+	conns := make(chan *inboundConn, 1)
+	s, addr := newStubProxy(t, func(srv *http.Server) {
+		srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			conns <- c.(*inboundConn)
+			return withInboundConn(ctx, c)
+		}
+	})
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	defer client.CloseIdleConnections()
+	send := func(host string, body io.Reader) {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/", body)
+		req.Host = host
+		if res, err := client.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}
+	// open the connection first, so the streams below share it
+	send("a.example", nil)
+	c := <-conns
+
+	// two overlapping streams, each held open by its unfinished body
+	var wg sync.WaitGroup
+	var bodies []*io.PipeWriter
+	done := make([]chan struct{}, 2)
+	for i, host := range []string{"a.example", "b.example"} {
+		pr, pw := io.Pipe()
+		bodies = append(bodies, pw)
+		done[i] = make(chan struct{})
+		wg.Go(func() {
+			defer close(done[i])
+			send(host, pr)
+		})
+	}
+	waitStreams := func(n int64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); c.streams.Load() != n; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v streams open, want %v", c.streams.Load(), n)
+			}
+		}
+	}
+	waitStreams(2)
+	c.mu.Lock()
+	waitStart, firstByte := c.waitStart, c.firstByte
+	c.mu.Unlock()
+
+	bodies[1].Close()
+	<-done[1]
+	waitStreams(1)
+	c.mu.Lock()
+	if !c.waitStart.Equal(waitStart) || !c.firstByte.Equal(firstByte) {
+		t.Errorf("one stream finishing reset the connection timing of the other: wait start %v, first byte %v, want %v, %v",
+			c.waitStart, c.firstByte, waitStart, firstByte)
+	}
+	c.mu.Unlock()
+	for name, vec := range map[string]histogramVec{"time to first byte": s.metrics.inboundTTFB, "receive time": s.metrics.inboundReceiveTime} {
+		if n := testutil.CollectAndCount(vec.vec); n != 0 {
+			t.Errorf("%v observed for an h2c stream, from timing shared by the connection", name)
+		}
+	}
+	bodies[0].Close()
+	wg.Wait()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inflightRegistry tracks the requests and tunnels being served, so that the admin server can list and cancel them.
+type inflightRegistry struct {
+	mu   sync.Mutex
+	next uint64
+	reqs map[uint64]*inflightRequest
+}
+
+type inflightKey struct{}
+
+type inflightRequest struct {
+	id       uint64
+	conn     uint64 // id of the inbound connection, 0 when it is not tracked
+	protocol string
+	client   string
+	method   string
+	target   string
+	started  time.Time
+	rule     atomic.Pointer[string]
+
+	cancel   context.CancelFunc
+	canceled atomic.Bool // canceled from the admin server
+}
+
+func newInflightRegistry() *inflightRegistry {
+	return &inflightRegistry{reqs: make(map[uint64]*inflightRequest)}
+}
+
+// track registers req and returns it with a context that canceling the entry cancels. done must be called when req finishes.
+func (r *inflightRegistry) track(req *http.Request) (entry *inflightRequest, ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(req.Context())
+	entry = &inflightRequest{protocol: inboundProtocol(req), client: req.RemoteAddr, method: req.Method, target: req.Host, started: time.Now(), cancel: cancel}
+	if c, ok := inboundConnFrom(req.Context()); ok {
+		entry.conn = c.id
+	}
+	entry.setRule(ruleLabelNone)
+	r.mu.Lock()
+	r.next++
+	entry.id = r.next
+	r.reqs[entry.id] = entry
+	r.mu.Unlock()
+	return entry, context.WithValue(ctx, inflightKey{}, entry), func() {
+		r.mu.Lock()
+		delete(r.reqs, entry.id)
+		r.mu.Unlock()
+		cancel()
+	}
+}
+
+// inflightFrom returns the entry of the request ctx belongs to, which dials made for the request see too.
+func inflightFrom(ctx context.Context) (*inflightRequest, bool) {
+	e, ok := ctx.Value(inflightKey{}).(*inflightRequest)
+	return e, ok
+}
+
+func (e *inflightRequest) setRule(name string) {
+	e.rule.Store(&name)
+}
+
+// cancel aborts the request with id, and reports whether it was still in flight.
+func (r *inflightRegistry) cancel(id uint64) (*inflightRequest, bool) {
+	r.mu.Lock()
+	entry, ok := r.reqs[id]
+	r.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	entry.canceled.Store(true)
+	entry.cancel()
+	return entry, true
+}
+
+// abortIfCanceled closes the client connection of a request canceled from the admin server, instead of answering it.
+func abortIfCanceled(e *inflightRequest) {
+	if e.canceled.Load() {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// inflightInfo is an in-flight request as listed by the admin server.
+type inflightInfo struct {
+	ID       uint64    `json:"id"`
+	Conn     uint64    `json:"conn,omitempty"` // requests with the same conn share an inbound connection
+	Protocol string    `json:"protocol"`
+	Client   string    `json:"client"`
+	Method   string    `json:"method"`
+	Target   string    `json:"target"`
+	Rule     string    `json:"rule"`
+	Started  time.Time `json:"started"`
+}
+
+func (r *inflightRegistry) list() []inflightInfo {
+	r.mu.Lock()
+	infos := make([]inflightInfo, 0, len(r.reqs))
+	for _, e := range r.reqs {
+		infos = append(infos, inflightInfo{ID: e.id, Conn: e.conn, Protocol: e.protocol, Client: e.client, Method: e.method, Target: e.target, Rule: *e.rule.Load(), Started: e.started})
+	}
+	r.mu.Unlock()
+	slices.SortFunc(infos, func(a, b inflightInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return infos
+}
+
+func (s *H2SProxyServer) connectionsHandler(wr http.ResponseWriter, req *http.Request) {
+	writeJSON(wr, http.StatusOK, s.inflight.list())
+}
+
+// cancelHandler cancels an in-flight request: its upstream request is aborted and the client connection closed.
+func (s *H2SProxyServer) cancelHandler(wr http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(req.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(wr, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	entry, ok := s.inflight.cancel(id)
+	if !ok {
+		writeJSON(wr, http.StatusNotFound, map[string]string{"error": "no such request"})
+		return
+	}
+	s.logger.Warnw("request canceled from the admin server", "id", id, "client", entry.client, "method", entry.method,
+		"target", entry.target, "rule", *entry.rule.Load(), "age", time.Since(entry.started).Round(time.Millisecond))
+	wr.WriteHeader(http.StatusNoContent)
+}
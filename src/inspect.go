@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+// bodyInspector sees a copy of a response body while it streams to the client. Writes must not fail.
+type bodyInspector interface {
+	io.Writer
+	// report is called once the copy ended, complete is false when it failed midway
+	report(s *H2SProxyServer, rule string, url *url.URL, complete bool)
+}
+
+func newBodyInspector(cfg domain.BodyInspector) bodyInspector {
+	switch cfg.Type {
+	case domain.InspectorScan:
+		return &scanInspector{name: cfg.Name, pattern: []byte(cfg.Pattern)}
+	case domain.InspectorSHA256:
+		return &sha256Inspector{name: cfg.Name, h: sha256.New()}
+	}
+	return nil
+}
+
+// inspectBody returns the body to copy to the client, teed into the inspectors applying to res,
+// and the function reporting their results.
+func (s *H2SProxyServer) inspectBody(profile *domain.Profile, rule string, url *url.URL, res *http.Response) (io.Reader, func(complete bool)) {
+	var inspectors []bodyInspector
+	var writers []io.Writer
+	for _, cfg := range profile.BodyInspectors {
+		if cfg.Applies(res.Header.Get("Content-Type")) {
+			bi := newBodyInspector(cfg)
+			inspectors = append(inspectors, bi)
+			writers = append(writers, bi)
+		}
+	}
+	if len(inspectors) == 0 {
+		return res.Body, func(bool) {}
+	}
+	return io.TeeReader(res.Body, io.MultiWriter(writers...)), func(complete bool) {
+		for _, bi := range inspectors {
+			bi.report(s, rule, url, complete)
+		}
+	}
+}
+
+// scanInspector counts occurrences of a literal pattern, including ones split across reads.
+type scanInspector struct {
+	name    string
+	pattern []byte
+	tail    []byte // end of the previous write that may start an occurrence
+	matches int
+}
+
+func (si *scanInspector) Write(b []byte) (int, error) {
+	buf := append(si.tail, b...)
+	rest := buf
+	for {
+		i := bytes.Index(rest, si.pattern)
+		if i < 0 {
+			break
+		}
+		si.matches++
+		rest = rest[i+len(si.pattern):]
+	}
+	if keep := len(si.pattern) - 1; len(rest) > keep {
+		rest = rest[len(rest)-keep:]
+	}
+	si.tail = append(si.tail[:0:0], rest...)
+	return len(b), nil
+}
+
+func (si *scanInspector) report(s *H2SProxyServer, rule string, url *url.URL, complete bool) {
+	if si.matches == 0 {
+		return
+	}
+	s.metrics.bodyMatches.add(float64(si.matches), rule, si.name)
+	s.logger.Warnw("response body matched", "inspector", si.name, "rule", rule, "url", url, "matches", si.matches, "complete", complete)
+}
+
+// sha256Inspector logs the digest of complete bodies, e.g. to check downloads against known hashes.
+type sha256Inspector struct {
+	name string
+	h    hash.Hash
+	n    int64
+}
+
+func (hi *sha256Inspector) Write(b []byte) (int, error) {
+	hi.n += int64(len(b))
+	return hi.h.Write(b)
+}
+
+func (hi *sha256Inspector) report(s *H2SProxyServer, rule string, url *url.URL, complete bool) {
+	if !complete {
+		return
+	}
+	s.logger.Infow("response body digest", "inspector", hi.name, "rule", rule, "url", url, "bytes", hi.n, "sha256", hex.EncodeToString(hi.h.Sum(nil)))
+}
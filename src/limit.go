@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+// errConcurrencyLimit is returned when a rule has concurrency.max requests open upstream and no slot freed in time.
+var errConcurrencyLimit = errors.New("rule concurrency limit reached")
+
+// ruleLimits holds a semaphore per rule name, so that requests in flight keep counting across reloads.
+type ruleLimits struct {
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newRuleLimits() *ruleLimits {
+	return &ruleLimits{slots: make(map[string]chan struct{})}
+}
+
+// get returns the semaphore of rule with max slots. A changed max starts a new semaphore;
+// requests holding a slot of the old one free it there.
+func (l *ruleLimits) get(rule string, max int) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots, ok := l.slots[rule]
+	if !ok || cap(slots) != max {
+		slots = make(chan struct{}, max)
+		l.slots[rule] = slots
+	}
+	return slots
+}
+
+// acquireSlot takes a concurrency slot of rule, waiting up to its queue_timeout for one to free.
+// release must be called once the upstream request or tunnel is done.
+func (s *H2SProxyServer) acquireSlot(ctx context.Context, rule *domain.Rule) (release func(), err error) {
+	if rule == nil || rule.Concurrency.Max == 0 {
+		return func() {}, nil
+	}
+	slots := s.limits.get(rule.Name, rule.Concurrency.Max)
+	select {
+	case slots <- struct{}{}:
+	default:
+		timeout := time.Duration(rule.Concurrency.QueueTimeout)
+		if timeout == 0 {
+			return nil, errConcurrencyLimit
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-s.clock.After(timeout):
+			return nil, errConcurrencyLimit
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	s.metrics.ruleActive.add(1, rule.Name)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-slots
+			s.metrics.ruleActive.add(-1, rule.Name)
+		})
+	}, nil
+}
+
+// slotConn frees the concurrency slot of a tunnel when its upstream connection is closed.
+type slotConn struct {
+	net.Conn
+	release func()
+}
+
+func (c slotConn) Close() error {
+	defer c.release()
+	return c.Conn.Close()
+}
+
+func (c slotConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// viaLoop reports whether a Via header of header names the proxy as id, i.e. the request already passed through it.
+func viaLoop(header http.Header, id string) bool {
+	for _, v := range header.Values("Via") {
+		for entry := range strings.SplitSeq(v, ",") {
+			// received-protocol received-by [comment]
+			if fields := strings.Fields(entry); len(fields) >= 2 && strings.EqualFold(fields[1], id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addVia records in the Via header of header that the proxy, named id, received req.
+func addVia(header http.Header, req *http.Request, id string) {
+	proto := strconv.Itoa(req.ProtoMajor)
+	if req.ProtoMajor < 2 {
+		proto += "." + strconv.Itoa(req.ProtoMinor)
+	}
+	header.Add("Via", proto+" "+id)
+}
@@ -1,21 +1,32 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/shirobrak/h2s-proxy/domain"
+	"go.opentelemetry.io/otel/propagation"
 	"go.uber.org/zap"
-	"golang.org/x/net/proxy"
+	"go.uber.org/zap/zapcore"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 var logoFigure string = `
 _   _ ____  ____  ____
 | | | |___ \/ ___||  _ \ _ __ _____  ___   _
@@ -25,8 +36,12 @@ _   _ ____  ____  ____
                                        |___/
 `
 
+// defaultRuleName labels requests that matched no rule and are sent directly.
+const defaultRuleName = "default"
+
 // https://datatracker.ietf.org/doc/html/rfc9110#section-7.6.1
 var hopByHopHeaders = []string{
+	"Connection",
 	"Proxy-Connection",
 	"Keep-Alive",
 	"TE",
@@ -35,17 +50,108 @@ var hopByHopHeaders = []string{
 }
 
 func removeHopByHopHeader(header http.Header) {
+	// headers listed in Connection are hop-by-hop as well
+	for _, v := range header.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
 	for _, h := range hopByHopHeaders {
 		header.Del(h)
 	}
 }
 
-func addHost2XForwardHeader(header http.Header, host string) {
-	var nextValue = ""
+// errTooManyForwardedFor is returned by addHost2XForwardHeader when the chain exceeds max_x_forwarded_for.
+var errTooManyForwardedFor = errors.New("too many X-Forwarded-For entries")
+
+// addHost2XForwardHeader appends host to the X-Forwarded-For chain, applying the chain options of profile.
+func addHost2XForwardHeader(header http.Header, host string, profile *domain.Profile) error {
+	var nextValue = host
 	if prior, ok := header["X-Forwarded-For"]; ok {
 		nextValue = strings.Join(prior, ", ") + ", " + host
 	}
+	if profile.CollapseForwardedFor {
+		nextValue = collapseForwardedFor(nextValue)
+	}
+	if entries := strings.Split(nextValue, ","); len(entries) > profile.MaxForwardedFor {
+		if profile.ForwardedForOverflow == domain.ForwardedForReject {
+			return errTooManyForwardedFor
+		}
+		// the most recent hops are the ones added by trusted proxies, the oldest are what a client can stuff
+		nextValue = strings.TrimSpace(strings.Join(entries[len(entries)-profile.MaxForwardedFor:], ","))
+	}
 	header.Set("X-Forwarded-For", nextValue)
+	return nil
+}
+
+// collapseForwardedFor drops entries of an X-Forwarded-For chain that repeat the entry before them.
+func collapseForwardedFor(chain string) string {
+	var entries []string
+	for entry := range strings.SplitSeq(chain, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || len(entries) > 0 && entries[len(entries)-1] == entry {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return strings.Join(entries, ", ")
+}
+
+// addForwardedHeader appends the RFC 7239 Forwarded element for the hop from the client to the proxy.
+func addForwardedHeader(header http.Header, req *http.Request) {
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	node := clientIP(req)
+	if strings.Contains(node, ":") {
+		// IPv6 nodes are bracketed, and quoted like any value with a ':'
+		node = "[" + node + "]"
+	}
+	elem := "for=" + forwardedValue(node) + ";proto=" + proto
+	if req.Host != "" {
+		elem += ";host=" + forwardedValue(req.Host)
+	}
+	if prior, ok := header["Forwarded"]; ok {
+		elem = strings.Join(prior, ", ") + ", " + elem
+	}
+	header.Set("Forwarded", elem)
+}
+
+// forwardedValue returns v as a token, or as a quoted-string when it has other characters.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	return c < 0x80 && (c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.ContainsRune("!#$%&'*+-.^_`|~", c))
+}
+
+// portNumber parses a destination port for matching, 0 when it is not a number.
+func portNumber(port string) int {
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// clientIP returns the IP of the peer that sent req.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// passRedirect hands 3xx responses to the client as they are, like any other proxy response.
+func passRedirect(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
 }
 
 func copyHeader(dst, src http.Header) {
@@ -56,127 +162,567 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-type H2SProxyServer struct {
-	profile *domain.Profile
-	logger  *zap.SugaredLogger
+// restoreTransparentURL turns an origin-form request redirected to the proxy into an absolute one.
+// The URL points at the original destination so the dial goes where the client was connecting,
+// while the Host header is kept as sent.
+func restoreTransparentURL(req *http.Request) error {
+	ic, ok := inboundConnFrom(req.Context())
+	if !ok {
+		return errors.New("connection not tracked")
+	}
+	dst, err := originalDst(ic.Conn)
+	if err != nil {
+		return err
+	}
+	if local, ok := ic.LocalAddr().(*net.TCPAddr); ok && local.IP.Equal(dst.IP) && local.Port == dst.Port {
+		return errors.New("request was sent to the proxy itself, not redirected")
+	}
+	req.URL.Scheme = "http"
+	req.URL.Host = dst.String()
+	return nil
+}
+
+// unsupportedScheme explains why the proxy cannot relay a request for u, or returns "" when it can.
+// net/http lowercases the scheme of absolute URLs. WebSocket clients configured with a proxy open a CONNECT tunnel,
+// so ws and wss URLs only come from clients sending them in absolute form, which need to be told to use CONNECT.
+func unsupportedScheme(u *url.URL) string {
+	switch u.Scheme {
+	case "http", "https":
+		return ""
+	case "":
+		return "request target must be an absolute http or https URL, as sent by clients configured to use this proxy"
+	case "ws", "wss":
+		return "unsupported URL scheme " + u.Scheme + ", tunnel WebSocket connections with CONNECT"
+	}
+	return "unsupported URL scheme " + u.Scheme + ", only http and https URLs are proxied"
 }
 
-func NewH2SProxyServer(profile *domain.Profile, logger *zap.SugaredLogger) *H2SProxyServer {
-	return &H2SProxyServer{
-		profile: profile,
-		logger:  logger,
+// matchRoute returns the rule for target along with the pattern of it that matched, or nil when the request takes
+// the default direct route. With circuit_breaker, matching rules with an open circuit are skipped.
+func (s *H2SProxyServer) matchRoute(ctx context.Context, profile *domain.Profile, target *domain.Target) (*domain.Rule, string, error) {
+	matched := s.matchRules(ctx, profile, target)
+	if len(matched) == 0 {
+		return nil, "", nil
+	}
+	rule, err := s.pickHealthy(ctx, profile, matched, true)
+	if err != nil {
+		return nil, "", err
+	}
+	pattern := rule.MatchingPattern(*target)
+	s.metrics.patternMatches.inc(rule.Name, pattern)
+	return rule, pattern, nil
+}
+
+// matchRules returns all rules matching target in profile order.
+// With resolve_hostnames, a hostname matching no rule is resolved, its addresses are stored in target
+// and it is matched again by them.
+func (s *H2SProxyServer) matchRules(ctx context.Context, profile *domain.Profile, target *domain.Target) []domain.Rule {
+	matched := profile.MatchRules(*target)
+	if len(matched) == 0 && profile.ResolveHostnames && net.ParseIP(target.Host) == nil {
+		ips, err := s.resolver.lookup(ctx, dnsResolver(strings.Join(profile.DNSServers, ",")), target.Host, time.Duration(profile.ResolveCacheTTL), profile.ResolveConcurrency)
+		if err != nil {
+			s.loggerFor(ctx, nil).Debugf("failed to resolve %v for matching: %v", target.Host, err)
+		} else {
+			target.IPs = ips
+			matched = profile.MatchRules(*target)
+		}
 	}
+	return matched
 }
 
-func (s *H2SProxyServer) proxyHandler(wr http.ResponseWriter, req *http.Request) {
-	s.logger.Debugf("remoteAddr: %v, Method: %v, URL: %v\n", req.RemoteAddr, req.Method, req.URL)
+func routeName(rule *domain.Rule) string {
+	if rule == nil {
+		return defaultRuleName
+	}
+	return rule.Name
+}
+
+// loggerFor returns the logger for the request of ctx routed by rule: s.logger, raised to the rule's log_level,
+// and to info when the request was left out by debug_log_sampling. A nil rule stands for a request not routed yet.
+// A log_level below the global level has no effect, as the global level filters first.
+func (s *H2SProxyServer) loggerFor(ctx context.Context, rule *domain.Rule) *zap.SugaredLogger {
+	level := zapcore.DebugLevel
+	if rule != nil && rule.LogLevel != "" {
+		if l, err := zapcore.ParseLevel(rule.LogLevel); err == nil {
+			level = l
+		}
+	}
+	if level < zapcore.InfoLevel && !debugSampled(ctx) {
+		level = zapcore.InfoLevel
+	}
+	if level == zapcore.DebugLevel || !s.logger.Desugar().Core().Enabled(level) {
+		return s.logger
+	}
+	if log, ok := s.levelLoggers.Load(level); ok {
+		return log.(*zap.SugaredLogger)
+	}
+	log, _ := s.levelLoggers.LoadOrStore(level, s.logger.WithOptions(zap.IncreaseLevel(level)))
+	return log.(*zap.SugaredLogger)
+}
+
+// logHeaders logs header at debug level when log_headers is enabled, masking the values of redacted headers.
+func logHeaders(log *zap.SugaredLogger, profile *domain.Profile, msg string, url *url.URL, header http.Header, setHeaders []domain.HeaderField) {
+	if !profile.LogHeaders || !log.Desugar().Core().Enabled(zap.DebugLevel) {
+		return
+	}
+	logged := header.Clone()
+	redact := func(name string) {
+		if vv := logged.Values(name); len(vv) > 0 {
+			logged[http.CanonicalHeaderKey(name)] = []string{domain.Secret(vv[0]).String()}
+		}
+	}
+	for _, name := range profile.RedactHeaders {
+		redact(name)
+	}
+	// set_headers values are secrets, such as API keys, whatever their name
+	for _, h := range setHeaders {
+		redact(h.Name)
+	}
+	log.Debugw(msg, "url", url, "headers", logged)
+}
+
+// markResponse sets the configured proxied-by header, replacing any value copied from the upstream.
+func markResponse(profile *domain.Profile, header http.Header) {
+	h := profile.ProxiedByHeader
+	if h.Name == "" {
+		return
+	}
+	value := h.Value
+	if value == "" {
+		value = "h2s-proxy/" + version
+	}
+	header.Set(h.Name, value)
+}
+
+// userAgent identifies requests the proxy makes on its own behalf, as opposed to proxied ones.
+func userAgent(profile *domain.Profile) string {
+	if profile.UserAgent != "" {
+		return profile.UserAgent
+	}
+	return "h2s-proxy/" + version
+}
+
+// debugUnsampledKey marks the context of a request whose debug logs debug_log_sampling leaves out.
+type debugUnsampledKey struct{}
+
+// sampleDebug leaves the debug logs of all but 1 in debug_log_sampling requests out, by marking their context.
+// Sampling whole requests rather than log lines keeps the debug logs of a sampled request complete.
+func (s *H2SProxyServer) sampleDebug(ctx context.Context, profile *domain.Profile) context.Context {
+	n := profile.DebugLogSampling
+	if n <= 1 || !s.logger.Desugar().Core().Enabled(zap.DebugLevel) {
+		return ctx
+	}
+	if s.debugRequests.Add(1)%uint64(n) == 1 {
+		return ctx
+	}
+	return context.WithValue(ctx, debugUnsampledKey{}, true)
+}
+
+func debugSampled(ctx context.Context) bool {
+	unsampled, _ := ctx.Value(debugUnsampledKey{}).(bool)
+	return !unsampled
+}
+
+func (s *H2SProxyServer) proxyHandler(w http.ResponseWriter, req *http.Request) {
+	profile := s.profile.Load()
+	ctx, span := s.startSpan(req)
+	ctx = s.sampleDebug(ctx, profile)
+	reqLog := s.loggerFor(ctx, nil)
+	reqLog.Debugf("remoteAddr: %v, Method: %v, URL: %v\n", req.RemoteAddr, req.Method, req.URL)
+	tracked, ctx, untrack := s.inflight.track(req.WithContext(ctx))
+	defer untrack()
+	req = req.WithContext(ctx)
+	wr := &statusRecorder{ResponseWriter: w}
+	defer func() { endSpan(span, wr.status) }()
+	s.stats.active.Add(1)
+	defer s.stats.active.Add(-1)
+	inbound := s.startInbound(req)
+	inbound.tracked = tracked
+	defer inbound.finish()
+	defer s.countResponse(req, inbound, wr)
+	var user string
+	defer func() { s.auditRequest(req, user, inbound, wr) }()
+	markResponse(profile, wr.Header())
+
+	if s.shedder.shed(wr, req) {
+		return
+	}
+	if id := profile.ProxyID; id != "" && viaLoop(req.Header, id) {
+		s.logger.Warnw("proxy loop detected", "host", req.Host, "remoteAddr", req.RemoteAddr, "via", req.Header.Values("Via"))
+		http.Error(wr, "proxy loop detected: the request already passed through "+id, http.StatusLoopDetected)
+		return
+	}
+
+	if !profile.AllowsMethod(req.Method) {
+		s.logDenied(req.Host, "method not allowed", "method", req.Method)
+		wr.Header().Set("Allow", strings.Join(profile.AllowedMethods, ", "))
+		http.Error(wr, req.Method+" is not allowed by proxy policy", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if auth := profile.ProxyAuth; auth.Enabled() {
+		var ok bool
+		if user, ok = proxyUser(req, auth); !ok {
+			reqLog.Debugw("proxy authentication failed", "remoteAddr", req.RemoteAddr, "user", user)
+			requireProxyAuth(wr, auth)
+			return
+		}
+		// the credentials are for this proxy, not the upstream
+		req.Header.Del("Proxy-Authorization")
+	}
+
+	var claims map[string][]string
+	if cfg := &profile.JWT; cfg.Enabled() {
+		var err error
+		if claims, err = bearerClaims(req, cfg, s.clock.Now()); err != nil {
+			if cfg.Required {
+				reqLog.Debugw("bearer token rejected", "remoteAddr", req.RemoteAddr, "error", err)
+				requireBearerToken(wr, err)
+				return
+			}
+			reqLog.Debugw("routing without JWT claims", "remoteAddr", req.RemoteAddr, "error", err)
+		}
+	}
+
+	if req.Method == http.MethodConnect {
+		s.connectHandler(wr, req, profile, inbound, user, claims)
+		return
+	}
+
+	if d := time.Duration(profile.MaxRequestDuration); d > 0 {
+		// counted from arrival, so time spent on authentication and matching is included
+		ctx, cancel := context.WithDeadline(req.Context(), inbound.start.Add(d))
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
 
-	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
-		msg := "unsupported protocal scheme " + req.URL.Scheme
-		s.logger.Error(msg)
-		http.Error(wr, msg, http.StatusBadRequest)
+	if len(profile.CORS.AllowedOrigins) > 0 && isPreflight(req) {
+		answerPreflight(wr, req, profile.CORS)
 		return
 	}
 
-	host, _, err := net.SplitHostPort(req.URL.Host)
+	if profile.Transparent && req.URL.Host == "" {
+		if err := restoreTransparentURL(req); err != nil {
+			s.logger.Errorf("failed to restore transparent destination: %v", err)
+			http.Error(wr, "cannot determine destination", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.ProtoMajor == 2 && req.URL.Host == "" && req.Host != "" {
+		// h2c clients pointed at the proxy, e.g. gRPC, send no absolute URL; :authority is the destination
+		req.URL.Scheme = "http"
+		req.URL.Host = req.Host
+	}
+
+	if reason := unsupportedScheme(req.URL); reason != "" {
+		s.logger.Warnw("unsupported request target", "url", req.URL, "reason", reason)
+		http.Error(wr, reason, profile.UnsupportedSchemeStatus)
+		return
+	}
+
+	dest, err := parseDestination(req.URL.Host, defaultPort(req.URL.Scheme))
 	if err != nil {
-		s.logger.Errorf("failed to splitHostPort: %v", err)
-		http.Error(wr, "unexpected error", http.StatusInternalServerError)
+		s.logger.Warnw("invalid destination", "host", req.URL.Host, "error", err)
+		http.Error(wr, "invalid destination host", http.StatusBadRequest)
+		return
+	}
+	req.URL.Host = dest.authority()
+	host, port := dest.host, dest.port
+	if profile.PortBlocked(port) {
+		s.deny(wr, profile, req.URL.Host, "blocked port")
 		return
 	}
 
+	trailers := acceptsTrailers(req.Header)
 	removeHopByHopHeader(req.Header)
-	addHost2XForwardHeader(req.Header, host)
+	if trailers {
+		req.Header.Set("TE", "trailers")
+	}
+	if !profile.DisableForwardedFor {
+		if err := addHost2XForwardHeader(req.Header, clientIP(req), profile); err != nil {
+			s.logger.Warnw("X-Forwarded-For chain too long", "url", req.URL, "remoteAddr", req.RemoteAddr, "limit", profile.MaxForwardedFor)
+			http.Error(wr, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if profile.Forwarded {
+		addForwardedHeader(req.Header, req)
+	}
+	if profile.ClientIPHeader != "" {
+		// replace whatever the client sent, it must not be able to spoof its address
+		req.Header.Set(profile.ClientIPHeader, clientIP(req))
+	}
 
-	rule, err := s.profile.MatchRule(host)
-	if err != nil && err != domain.ErrNotFoundRule {
+	// matched for every request: keep-alive and h2c connections carry requests to different destinations,
+	// so nothing about routing may be kept on the connection
+	target := &domain.Target{
+		Host:   host,
+		Port:   portNumber(port),
+		Header: req.Header,
+		User:   user,
+		Claims: claims,
+		Time:   inbound.start,
+	}
+	matched, pattern, err := s.matchRoute(req.Context(), profile, target)
+	if errors.Is(err, errNoHealthyRule) {
+		s.logger.Warnw("no healthy rule", "url", req.URL)
+		http.Error(wr, "no healthy upstream for "+req.URL.Host, http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
 		s.logger.Errorf("failed to match rule: %v", err)
 		http.Error(wr, "unexpected error", http.StatusInternalServerError)
 		return
 	}
 
+	inbound.setRule(routeName(matched))
+
+	if reason := denyReason(profile, matched); reason != "" {
+		s.deny(wr, profile, req.URL.Host, reason, "rule", routeName(matched))
+		return
+	}
+	if addr, reason := s.privateDestination(req.Context(), profile, matched, target); reason != "" {
+		s.deny(wr, profile, req.URL.Host, reason, "rule", routeName(matched), "address", addr)
+		return
+	}
+	if s.maintenance.covers(routeName(matched)) {
+		s.refuseForMaintenance(wr, req, profile, req.URL.Host, routeName(matched))
+		return
+	}
+
+	if matched != nil {
+		if limit := matched.HeaderLimits.Exceeded(req.Header); limit != "" {
+			s.logger.Warnw("request headers exceed rule limit", "rule", matched.Name, "url", req.URL, "limit", limit)
+			http.Error(wr, "request headers exceed the limit of rule "+matched.Name, http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		if dropped := matched.FilterRequestHeaders(req.Header); len(dropped) > 0 {
+			s.loggerFor(req.Context(), matched).Debugw("dropped request headers not in allowed_request_headers", "rule", matched.Name, "url", req.URL, "headers", dropped)
+		}
+	}
+
 	if req.RequestURI != "" {
 		// http://golang.org/src/pkg/net/http/client.go
 		// It is an error to set this field in an HTTP client request.
 		req.RequestURI = ""
 	}
 
-	var client http.Client
-	if err == nil {
-		socksDialer, err := proxy.SOCKS5("tcp", fmt.Sprintf("%v:%v", rule.ProxyIP, rule.Port), nil, proxy.Direct)
-		if err != nil {
-			s.logger.Errorf("failed to create socksDailer: %v", err)
-			http.Error(wr, "unexpected error", http.StatusInternalServerError)
-			return
-		}
-		tr := http.Transport{
-			Dial: socksDialer.Dial,
-		}
-		client = http.Client{
-			Transport: &tr,
-		}
-		s.logger.Infow("proxy", "rule", rule.Name, "url", req.URL, "proxyType", rule.ProxyType, "proxyIP", rule.ProxyIP, "proxyPort", rule.Port)
+	ruleName := routeName(matched)
+	log := s.loggerFor(req.Context(), matched)
+	endpoint := s.pickEndpoint(matched)
+	grpc := isGRPC(req)
+	key := newTransportKey(profile, matched, endpoint)
+	key.grpc = grpc
+	tr, release, expired, err := s.transports.acquire(key, s.clock.Now())
+	if err != nil {
+		s.logger.Errorf("failed to create transport: %v", err)
+		http.Error(wr, "unexpected error", http.StatusInternalServerError)
+		return
+	}
+	if expired != nil {
+		s.logger.Debugw("replacing transport past max_conn_lifetime", "proxyType", key.proxyType, "proxyAddr", key.proxyAddr, "age", s.clock.Now().Sub(expired.created))
+		s.drainTransport(expired, func() {})
+	}
+	defer release()
+	setSpanRoute(req.Context(), matched, endpoint)
+	if matched != nil {
+		log.Infow("proxy", "rule", matched.Name, "pattern", pattern, "url", req.URL, "proxyType", matched.ProxyType, "proxyIP", endpoint.ProxyIP, "proxyPort", endpoint.Port)
 	} else {
-		// err == domain.ErrNotFoundRule
-		client = http.Client{}
-		s.logger.Infow("proxy", "rule", "default", "url", req.URL)
+		log.Infow("proxy", "rule", defaultRuleName, "url", req.URL)
+	}
+
+	req = req.WithContext(s.traceConnReuse(req.Context(), ruleName))
+	client := http.Client{Transport: tr}
+	if matched != nil && len(matched.HeaderOrder) > 0 && !grpc {
+		client.Transport = orderedTransport{tr: tr, order: matched.HeaderOrder}
+	}
+	if !profile.FollowRedirectsFor(matched) {
+		client.CheckRedirect = passRedirect
+	}
+	setHeaders := profile.SetHeadersFor(matched)
+	for _, h := range setHeaders {
+		// after allowed_request_headers, so configured headers are always sent
+		req.Header.Set(h.Name, h.Value)
+	}
+	if profile.ProxyID != "" {
+		// added after allowed_request_headers, which must not break loop detection
+		addVia(req.Header, req, profile.ProxyID)
 	}
-	res, err := client.Do(req)
+	tracePropagator.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	logHeaders(log, profile, "request headers", req.URL, req.Header, setHeaders)
+	releaseSlot, err := s.acquireSlot(req.Context(), matched)
 	if err != nil {
-		s.logger.Error("failed to do req: %v", err)
-		http.Error(wr, "unexpected error", http.StatusInternalServerError)
+		log.Warnw("request refused", "rule", ruleName, "url", req.URL, "error", err)
+		status := upstreamStatus(err)
+		http.Error(wr, http.StatusText(status), status)
+		return
+	}
+	defer releaseSlot()
+	res, err := s.doWithRetry(&client, req, profile.RetryFor(matched), profile.MaxBufferedBody, ruleName, log)
+	s.recordUpstream(req.Context(), profile, matched, err)
+	if err != nil {
+		abortIfCanceled(tracked)
+		if exceededDeadline(req) {
+			log.Errorw("request exceeded max_request_duration", "url", req.URL, "rule", ruleName, "limit", time.Duration(profile.MaxRequestDuration))
+			http.Error(wr, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+			return
+		}
+		s.upstreamError(wr, log, profile, matched, req.URL.Host, err)
 		return
 	}
 	defer res.Body.Close()
 
+	logHeaders(log, profile, "response headers", req.URL, res.Header, nil)
 	removeHopByHopHeader(res.Header)
 	copyHeader(wr.Header(), res.Header)
-	wr.WriteHeader(res.StatusCode)
-	_, err = io.Copy(wr, res.Body)
+	if loc := wr.Header().Get("Location"); loc != "" {
+		wr.Header().Set("Location", profile.RewriteLocationFor(matched).Rewrite(loc))
+	}
+	for _, name := range profile.StripResponseHeadersFor(matched) {
+		// a nil value also stops net/http from adding Content-Type or Date itself
+		wr.Header()[http.CanonicalHeaderKey(name)] = nil
+	}
+	markResponse(profile, wr.Header())
+	wr.writeUpstreamHeader(res.StatusCode)
+	var dst io.Writer = wr
+	if grpc {
+		dst = flushWriter{w: wr, f: wr}
+	}
+	body, reportInspection := s.inspectBody(profile, ruleName, req.URL, res)
+	_, err = s.copyBuffers.copy(dst, body, profile.CopyBufferSize)
+	reportInspection(err == nil)
 	if err != nil {
-		s.logger.Error("failed to copy body: %v", err)
+		abortIfCanceled(tracked)
+		if exceededDeadline(req) {
+			// the status is already sent, closing the connection tells the client the body is incomplete
+			log.Errorw("request exceeded max_request_duration during the response body", "url", req.URL, "rule", ruleName,
+				"limit", time.Duration(profile.MaxRequestDuration))
+			panic(http.ErrAbortHandler)
+		}
+		log.Errorf("failed to copy body: %v", err)
 		http.Error(wr, "unexpected error", http.StatusInternalServerError)
 		return
 	}
+	copyTrailer(wr, res.Trailer)
 }
 
-func (s *H2SProxyServer) Run() error {
-	var handler http.Handler
-	http.HandleFunc("/", s.proxyHandler)
-	return http.ListenAndServe(s.profile.GetServerAddr(), handler)
+// countResponse counts the response to a finished request by rule, status and whether the proxy or the upstream produced it,
+// and records the size of its bodies.
+func (s *H2SProxyServer) countResponse(req *http.Request, inbound *inboundRequest, wr *statusRecorder) {
+	status := wr.status
+	if status == 0 {
+		// net/http sends 200 for handlers that write nothing
+		status = http.StatusOK
+	}
+	s.metrics.responses.inc(inbound.rule, strconv.Itoa(status), wr.source())
+	if req.Method != http.MethodConnect {
+		s.metrics.requestBodySize.observe(float64(inbound.bodyBytes()), inbound.rule)
+		s.metrics.responseBodySize.observe(float64(wr.written), inbound.rule)
+	}
+	s.stats.count(inbound.rule, status, inbound.bodyBytes()+inbound.tunnelIn, wr.written+inbound.tunnelOut)
 }
 
-func loadProfile(path string) (*domain.Profile, error) {
+// loadProfile reads the profile at path, along with the schema version the file was written for
+// when it had to be migrated to domain.ProfileVersion, 0 otherwise.
+// loadProfile reads, migrates and validates the profile at path. A non-empty listen replaces its listen addresses
+// before validation, so the checks against them see the address actually bound.
+func loadProfile(path, listen string) (*domain.Profile, int, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer file.Close()
 	bytesFile, err := io.ReadAll(file)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	bytesFile, version, err := domain.MigrateProfile(bytesFile)
+	if err != nil {
+		return nil, 0, err
 	}
 	var profile domain.Profile
-	json.Unmarshal(bytesFile, &profile)
-	return &profile, nil
+	if err := json.Unmarshal(bytesFile, &profile); err != nil {
+		return nil, 0, err
+	}
+	if listen != "" {
+		if err := profile.OverrideListenAddr(listen); err != nil {
+			return nil, 0, fmt.Errorf("--listen: %w", err)
+		}
+	}
+	if err := profile.Prepare(); err != nil {
+		return nil, 0, err
+	}
+	if version == domain.ProfileVersion {
+		version = 0
+	}
+	return &profile, version, nil
+}
+
+// logMigration warns that the profile at path was written for an older schema version and has been upgraded in memory.
+func logMigration(logger *zap.SugaredLogger, path string, from int) {
+	if from != 0 {
+		logger.Warnw("profile upgraded from an older schema version, set version to silence this", "path", path, "from", from, "to", domain.ProfileVersion)
+	}
 }
 
+// listenEnv overrides the listen addresses of the profile, with lower precedence than --listen.
+const listenEnv = "H2S_PROXY_LISTEN"
+
 func main() {
 	var profilePath = flag.String("profile", "./profile.json", "profile path")
+	var logLevel = flag.String("log-level", "info", "log level (debug, info, warn, error)")
+	var preflight = flag.Bool("preflight", false, "dial every SOCKS endpoint before starting")
+	var preflightTimeout = flag.Duration("preflight-timeout", 5*time.Second, "time allowed for the preflight dials")
+	var initProfile = flag.Bool("init", false, "write an example profile to the profile path and exit")
+	var testMode = flag.Bool("test-mode", false, "answer every request from a stub echoing its route instead of contacting upstreams; not for production")
+	var readyFD = flag.Int("ready-fd", 0, "file descriptor to write a newline to and close once listening")
+	var listen = flag.String("listen", "", "host:port to listen on instead of the profile addresses, $"+listenEnv+" when unset")
 	flag.Parse()
-	profile, err := loadProfile(*profilePath)
+	if *initProfile {
+		if err := writeExampleProfile(*profilePath); err != nil {
+			log.Fatalf("failed to write example profile: %v\n", err)
+		}
+		fmt.Printf("wrote an example profile to %v, edit its rules and start the proxy with --profile=%v\n", *profilePath, *profilePath)
+		return
+	}
+	if *listen == "" {
+		*listen = os.Getenv(listenEnv)
+	}
+	profile, migratedFrom, err := loadProfile(*profilePath, *listen)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Fatalf("profile %v does not exist; pass --profile=<path>, or add --init to write an example profile there\n", *profilePath)
+	}
 	if err != nil {
 		log.Fatalf("failed to load profile: %v\n", err)
 	}
-	logger, err := zap.NewProduction()
+	level, err := zap.ParseAtomicLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("invalid log level: %v", err)
+	}
+	logConfig := zap.NewProductionConfig()
+	logConfig.Level = level
+	logger, err := logConfig.Build()
 	if err != nil {
 		log.Fatalf("failed to create logger: %v", err)
 	}
 	defer logger.Sync()
 
-	h2sProxyServer := NewH2SProxyServer(profile, logger.Sugar())
+	logMigration(logger.Sugar(), *profilePath, migratedFrom)
+	h2sProxyServer := NewH2SProxyServer(*profilePath, profile, logger.Sugar())
+	h2sProxyServer.readyFD = *readyFD
+	h2sProxyServer.listen = *listen
+	h2sProxyServer.transports.stub = *testMode
+	if *preflight && *testMode {
+		log.Fatalf("--preflight dials the SOCKS servers, which --test-mode does not use\n")
+	}
+	if *preflight {
+		if err := h2sProxyServer.preflight(*preflightTimeout); err != nil {
+			log.Fatalf("preflight failed: %v\n", err)
+		}
+	}
 	fmt.Println(logoFigure)
-	fmt.Printf("H2SProxy server start, listening [%v]...\n", profile.GetServerAddr())
+	fmt.Printf("H2SProxy server start, listening [%v]...\n", strings.Join(profile.GetServerAddrs(), ", "))
 	if err := h2sProxyServer.Run(); err != nil {
 		log.Fatalf("H2SProxyServer down: %v\n", err)
 	}
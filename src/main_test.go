@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// newTestServer loads profile, given as JSON, into a server that is not running.
+func newTestServer(t *testing.T, profile string) *H2SProxyServer {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "profile.json")
+	if err := os.WriteFile(path, []byte(profile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, _, err := loadProfile(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewH2SProxyServer(path, p, zap.NewNop().Sugar())
+}
+
+// newTestProxy serves the proxy with profile, given as JSON, the way Run does, after applying configure to its server.
+// Listen addresses of the profile are ignored.
+func newTestProxy(t *testing.T, profile string, configure ...func(*http.Server)) (*H2SProxyServer, *httptest.Server) {
+	t.Helper()
+	s := newTestServer(t, profile)
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Listener = &inboundListener{Listener: ts.Listener, metrics: s.metrics, shedder: s.shedder}
+	ts.Config = s.proxyServer(s.profile.Load())
+	for _, f := range configure {
+		f(ts.Config)
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func TestRemoveHopByHopHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		removed []string
+		kept    []string
+	}{
+		{name: "Connection", header: http.Header{"Connection": {"keep-alive"}}, removed: []string{"Connection"}},
+		{name: "Proxy-Connection", header: http.Header{"Proxy-Connection": {"keep-alive"}}, removed: []string{"Proxy-Connection"}},
+		{name: "Keep-Alive", header: http.Header{"Keep-Alive": {"timeout=5"}}, removed: []string{"Keep-Alive"}},
+		{name: "TE", header: http.Header{"Te": {"trailers"}}, removed: []string{"Te"}},
+		{name: "Transfer-Encoding", header: http.Header{"Transfer-Encoding": {"chunked"}}, removed: []string{"Transfer-Encoding"}},
+		{name: "Upgrade", header: http.Header{"Upgrade": {"websocket"}}, removed: []string{"Upgrade"}},
+		{
+			name:    "listed in Connection",
+			header:  http.Header{"Connection": {"X-Hop, x-other"}, "X-Hop": {"1"}, "X-Other": {"2"}, "X-End": {"3"}},
+			removed: []string{"Connection", "X-Hop", "X-Other"},
+			kept:    []string{"X-End"},
+		},
+		{
+			name:    "listed in several Connection values",
+			header:  http.Header{"Connection": {"close", " X-Hop ,,"}, "X-Hop": {"1"}},
+			removed: []string{"Connection", "X-Hop"},
+		},
+		{
+			name: "end-to-end headers",
+			header: http.Header{
+				"Accept":        {"*/*"},
+				"Authorization": {"Bearer t"},
+				"Content-Type":  {"text/plain"},
+				"Cookie":        {"a=1", "b=2"},
+				"Trailer":       {"X-Checksum"},
+			},
+			kept: []string{"Accept", "Authorization", "Content-Type", "Cookie", "Trailer"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.header.Clone()
+			removeHopByHopHeader(tt.header)
+			for _, name := range tt.removed {
+				if v, ok := tt.header[name]; ok {
+					t.Errorf("%s not removed, got %q", name, v)
+				}
+			}
+			for _, name := range tt.kept {
+				if got := tt.header[name]; !slices.Equal(got, want[name]) {
+					t.Errorf("%s = %q, want %q", name, got, want[name])
+				}
+			}
+		})
+	}
+}
+
+func TestCopyHeader(t *testing.T) {
+	dst := http.Header{"Set-Cookie": {"a=1"}, "X-Dst": {"d"}}
+	src := http.Header{"Set-Cookie": {"b=2", "c=3"}, "Vary": {"Accept", "Origin"}}
+	copyHeader(dst, src)
+	want := http.Header{"Set-Cookie": {"a=1", "b=2", "c=3"}, "Vary": {"Accept", "Origin"}, "X-Dst": {"d"}}
+	if len(dst) != len(want) {
+		t.Fatalf("got %v, want %v", dst, want)
+	}
+	for name, vv := range want {
+		if !slices.Equal(dst[name], vv) {
+			t.Errorf("%s = %q, want %q", name, dst[name], vv)
+		}
+	}
+	src["Vary"][0] = "changed"
+	if dst["Vary"][0] != "Accept" {
+		t.Error("copyHeader shares value slices with src")
+	}
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	_, addr := newStubProxy(t)
+	tests := []struct {
+		name   string
+		target string
+		header string
+		status int
+		body   string // substring of the response body
+	}{
+		{name: "ws", target: "ws://a.example/chat", status: http.StatusBadRequest, body: "tunnel WebSocket connections with CONNECT"},
+		{name: "uppercase wss", target: "WSS://a.example/chat", status: http.StatusBadRequest, body: "unsupported URL scheme wss"},
+		{name: "ftp", target: "ftp://a.example/file", status: http.StatusBadRequest, body: "only http and https URLs are proxied"},
+		{name: "origin-form", target: "/index.html", status: http.StatusBadRequest, body: "must be an absolute http or https URL"},
+		{name: "uppercase http", target: "HTTP://a.example/", status: http.StatusOK, body: `"rule": "a"`},
+		{
+			// WebSocket handshakes sent in absolute form are http requests asking to upgrade
+			name:   "http with Upgrade",
+			target: "http://b.example/chat",
+			header: "Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n",
+			status: http.StatusOK,
+			body:   `"rule": "b"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: a.example\r\n%s\r\n", tt.target, tt.header)
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != tt.status || !strings.Contains(string(body), tt.body) {
+				t.Errorf("got %v %q, want %v with %q", res.StatusCode, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+// uploadReader generates size bytes of a repeating pattern. Halfway through it waits until received reports
+// a quarter of the body has reached the upstream, failing when it never does.
+type uploadReader struct {
+	size, sent int64
+	received   func() int64
+	waited     bool
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	if r.sent >= r.size {
+		return 0, io.EOF
+	}
+	if !r.waited && r.sent >= r.size/2 {
+		r.waited = true
+		for deadline := time.Now().Add(10 * time.Second); r.received() < r.size/4; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				return 0, errors.New("the upstream had not received a quarter of the body once half of it was sent")
+			}
+		}
+	}
+	p = p[:min(int64(len(p)), r.size-r.sent)]
+	for i := range p {
+		p[i] = byte(r.sent + int64(i))
+	}
+	r.sent += int64(len(p))
+	return len(p), nil
+}
+
+func TestLargeUploadIsStreamed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sends two 256MB bodies through the proxy")
+	}
+	const size = 256 << 20
+	var received atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h := crc32.NewIEEE()
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := req.Body.Read(buf)
+			h.Write(buf[:n])
+			received.Add(int64(n))
+			if err != nil {
+				break
+			}
+		}
+		fmt.Fprintf(w, "%d %08x", received.Load(), h.Sum32())
+	}))
+	defer upstream.Close()
+	// retries make the proxy buffer bodies up to max_buffered_body, so larger ones must fall back to streaming
+	_, proxy := newTestProxy(t, `{"version": 2, "listen_addrs": ["127.0.0.1:0"], "retry": {"attempts": 2, "backoff": "10ms", "idempotent": true}}`)
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer client.CloseIdleConnections()
+
+	h := crc32.NewIEEE()
+	io.Copy(h, &uploadReader{size: size, received: func() int64 { return size / 4 }})
+	want := fmt.Sprintf("%d %08x", size, h.Sum32())
+	for _, chunked := range []bool{false, true} {
+		t.Run(fmt.Sprintf("chunked=%v", chunked), func(t *testing.T) {
+			received.Store(0)
+			body := &uploadReader{size: size, received: received.Load}
+			req, _ := http.NewRequest(http.MethodPut, upstream.URL+"/artifact", io.NopCloser(body))
+			if !chunked {
+				req.ContentLength = size
+			}
+			runtime.GC()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			runtime.ReadMemStats(&after)
+			if res.StatusCode != http.StatusOK || string(got) != want {
+				t.Fatalf("got %v %q, want 200 %q", res.StatusCode, got, want)
+			}
+			// client, proxy and upstream together, far below the body size when nothing holds it in memory
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/16 {
+				t.Errorf("allocated %v bytes to proxy a %v-byte body", alloc, size)
+			}
+		})
+	}
+}
+
+func TestLogHeadersMasksSetHeaders(t *testing.T) {
+	s := newTestServer(t, `{
+  "version": 2,
+  "listen_addrs": ["127.0.0.1:0"],
+  "log_headers": true,
+  "set_headers": {"X-Api-Key": "shared-key-123"},
+  "rules": [{"name": "partner", "patterns": ["10.0.0.0/8"], "proxy_ip": "192.0.2.1", "port": "1080", "set_headers": {"X-Partner-Token": "partner-token-456"}}]
+}`)
+	profile := s.profile.Load()
+	core, logs := observer.New(zapcore.DebugLevel)
+	header := http.Header{"Accept": {"*/*"}, "Authorization": {"Bearer client-token-789"}}
+	setHeaders := profile.SetHeadersFor(&profile.Rules[0])
+	for _, h := range setHeaders {
+		header.Set(h.Name, h.Value)
+	}
+	u, _ := url.Parse("http://10.1.2.3/")
+	logHeaders(zap.New(core).Sugar(), profile, "request headers", u, header, setHeaders)
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("got %v log entries, want 1", len(entries))
+	}
+	logged := fmt.Sprint(entries[0].ContextMap()["headers"])
+	for _, secret := range []string{"shared-key-123", "partner-token-456", "client-token-789"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("header log %v contains %q", logged, secret)
+		}
+	}
+	if !strings.Contains(logged, "*/*") || !strings.Contains(logged, domain.Secret("x").String()) {
+		t.Errorf("header log %v lacks the unmasked Accept header or the masked values", logged)
+	}
+}
+
+func TestListenOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profile.json")
+	profile := `{"version": 2, "listen_addrs": ["127.0.0.1:8080"], "pprof": {"enabled": true, "addr": "127.0.0.1:6060"}}`
+	if err := os.WriteFile(path, []byte(profile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadProfile(path, "127.0.0.1:6060"); err == nil {
+		t.Error("listen override sharing the pprof port: got no error")
+	}
+
+	p, _, err := loadProfile(path, "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewH2SProxyServer(path, p, zap.NewNop().Sugar())
+	s.listen = "127.0.0.1:9000"
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.profile.Load().GetServerAddrs(); !slices.Equal(got, []string{"127.0.0.1:9000"}) {
+		t.Errorf("listening on %v after a reload, want the override 127.0.0.1:9000", got)
+	}
+}
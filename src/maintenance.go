@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+	"go.uber.org/zap"
+)
+
+// maintenancePollInterval is how often maintenance.file is checked for existence.
+const maintenancePollInterval = time.Second
+
+// maintenanceScope is the part of the traffic in maintenance: every request, or those routed to some rules.
+type maintenanceScope struct {
+	All   bool     `json:"all"`
+	Rules []string `json:"rules,omitempty"`
+}
+
+func (m maintenanceScope) active() bool {
+	return m.All || len(m.Rules) > 0
+}
+
+func (m maintenanceScope) covers(rule string) bool {
+	return m.All || slices.Contains(m.Rules, rule)
+}
+
+// maintenance holds the scopes set from the admin server and by the maintenance file.
+// Either one puts a request in maintenance.
+type maintenance struct {
+	mu     sync.RWMutex
+	admin  maintenanceScope
+	file   maintenanceScope
+	logger *zap.SugaredLogger
+}
+
+// covers reports whether requests routed to rule are in maintenance.
+func (m *maintenance) covers(rule string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.admin.covers(rule) || m.file.covers(rule)
+}
+
+// all reports whether every request is in maintenance, whatever rule it matches.
+func (m *maintenance) all() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.admin.All || m.file.All
+}
+
+func (m *maintenance) set(source string, scope maintenanceScope) {
+	m.update(source, func(maintenanceScope) maintenanceScope { return scope })
+}
+
+// update replaces the scope of source, admin or file, by what change returns for the current one,
+// logging when maintenance is entered, changed or exited.
+func (m *maintenance) update(source string, change func(maintenanceScope) maintenanceScope) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur := &m.admin
+	if source == "file" {
+		cur = &m.file
+	}
+	scope := change(*cur)
+	if cur.All == scope.All && slices.Equal(cur.Rules, scope.Rules) {
+		return
+	}
+	switch {
+	case !scope.active():
+		m.logger.Warnw("maintenance mode exited", "source", source)
+	case cur.active():
+		m.logger.Warnw("maintenance mode changed", "source", source, "all", scope.All, "rules", scope.Rules)
+	default:
+		m.logger.Warnw("maintenance mode entered", "source", source, "all", scope.All, "rules", scope.Rules)
+	}
+	*cur = scope
+}
+
+func (m *maintenance) status() map[string]maintenanceScope {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return map[string]maintenanceScope{"admin": m.admin, "file": m.file}
+}
+
+// watchMaintenanceFile follows the existence and content of maintenance.file until ctx is done.
+// The path is read from the current profile on every check, so a reload can change it.
+func (s *H2SProxyServer) watchMaintenanceFile(ctx context.Context) {
+	ticker := time.NewTicker(maintenancePollInterval)
+	defer ticker.Stop()
+	for {
+		s.maintenance.set("file", s.readMaintenanceFile(s.profile.Load().Maintenance.File))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *H2SProxyServer) readMaintenanceFile(path string) maintenanceScope {
+	if path == "" {
+		return maintenanceScope{}
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return maintenanceScope{}
+	}
+	if err != nil {
+		// present but unreadable: err on the side of the operator who created it
+		s.logger.Warnw("failed to read maintenance file, applying it to all requests", "path", path, "error", err)
+		return maintenanceScope{All: true}
+	}
+	var rules []string
+	for line := range strings.Lines(string(b)) {
+		if name := strings.TrimSpace(line); name != "" && !slices.Contains(rules, name) {
+			rules = append(rules, name)
+		}
+	}
+	slices.Sort(rules)
+	return maintenanceScope{All: len(rules) == 0, Rules: rules}
+}
+
+// refuseForMaintenance answers a request in maintenance with 503 and the configured Retry-After.
+func (s *H2SProxyServer) refuseForMaintenance(wr http.ResponseWriter, req *http.Request, profile *domain.Profile, dest, rule string) {
+	s.loggerFor(req.Context(), nil).Debugw("request refused for maintenance", "destination", dest, "rule", rule)
+	retryAfter := (time.Duration(profile.Maintenance.RetryAfter) + time.Second - 1) / time.Second
+	wr.Header().Set("Retry-After", strconv.FormatInt(int64(retryAfter), 10))
+	http.Error(wr, "service under maintenance, retry later", http.StatusServiceUnavailable)
+}
+
+func (s *H2SProxyServer) maintenanceHandler(wr http.ResponseWriter, req *http.Request) {
+	writeJSON(wr, http.StatusOK, s.maintenance.status())
+}
+
+// enterMaintenanceHandler puts the rules given as rule parameters in maintenance, or every request when none is given.
+func (s *H2SProxyServer) enterMaintenanceHandler(wr http.ResponseWriter, req *http.Request) {
+	rules := req.URL.Query()["rule"]
+	s.maintenance.update("admin", func(scope maintenanceScope) maintenanceScope {
+		if len(rules) == 0 {
+			return maintenanceScope{All: true}
+		}
+		scope.Rules = slices.Clone(scope.Rules)
+		for _, rule := range rules {
+			if !slices.Contains(scope.Rules, rule) {
+				scope.Rules = append(scope.Rules, rule)
+			}
+		}
+		slices.Sort(scope.Rules)
+		return scope
+	})
+	writeJSON(wr, http.StatusOK, s.maintenance.status())
+}
+
+// exitMaintenanceHandler takes the rules given as rule parameters out of maintenance, or ends it when none is given.
+// Maintenance set by the maintenance file lasts until the file is removed.
+func (s *H2SProxyServer) exitMaintenanceHandler(wr http.ResponseWriter, req *http.Request) {
+	rules := req.URL.Query()["rule"]
+	s.maintenance.update("admin", func(scope maintenanceScope) maintenanceScope {
+		if len(rules) == 0 {
+			return maintenanceScope{}
+		}
+		scope.Rules = slices.DeleteFunc(slices.Clone(scope.Rules), func(r string) bool { return slices.Contains(rules, r) })
+		if len(scope.Rules) == 0 {
+			scope.Rules = nil
+		}
+		return scope
+	})
+	writeJSON(wr, http.StatusOK, s.maintenance.status())
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "h2s_proxy"
+
+// ruleLabelNone labels metrics recorded before a request could be matched to a rule.
+const ruleLabelNone = "none"
+
+// metrics holds the instruments of the proxy. With disable_metrics they are all unset, which the
+// recording methods below check first, so no label lookup or atomic update is left on the request path.
+type metrics struct {
+	registry *prometheus.Registry // nil when metrics are disabled
+
+	inboundTTFB         histogramVec
+	inboundReceiveTime  histogramVec
+	inboundReadTimeouts counterVec
+	inboundConnRequests histogramVec
+	inboundStreams      histogramVec
+
+	upstreamConns      counterVec
+	upstreamRetries    counterVec
+	upstreamCertErrors counterVec
+	socksErrors        counterVec
+
+	endpointRequests counterVec
+	patternMatches   counterVec
+	responses        counterVec
+	requestBodySize  histogramVec
+	responseBodySize histogramVec
+	bodyMatches      counterVec
+	circuitOpen      gaugeVec
+	ruleActive       gaugeVec
+	decisionCache    counterVec
+	syslogDropped    counter
+	auditDropped     counter
+
+	inboundConnsOpen gauge
+	loadShedding     gauge
+	loadShedRequests counter
+}
+
+func newMetrics(enabled bool) *metrics {
+	if !enabled {
+		return &metrics{}
+	}
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		inboundTTFB: histogramVec{prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "inbound_time_to_first_byte_seconds",
+			Help:      "Time from accepting a connection (or finishing the previous request on it) to the first byte of the request.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"rule"})},
+		inboundReceiveTime: histogramVec{prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "inbound_receive_duration_seconds",
+			Help:      "Time from the first byte of the request until its headers and body were fully received.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"rule"})},
+		inboundReadTimeouts: counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "inbound_read_timeouts_total",
+			Help:      "Inbound requests aborted because the client did not send them within the read timeout.",
+		}, []string{"rule"})},
+		inboundConnRequests: histogramVec{prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "inbound_connection_requests",
+			Help:      "Requests served on an inbound connection, observed when it closes.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}, []string{"protocol"})},
+		inboundStreams: histogramVec{prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "inbound_concurrent_streams",
+			Help:      "Requests open on the inbound connection when a request starts, itself included.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 9),
+		}, []string{"protocol"})},
+		upstreamConns: counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_connections_total",
+			Help:      "Upstream connections obtained for requests, split by whether they were reused from the pool.",
+		}, []string{"rule", "reused"})},
+		upstreamRetries: counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_retries_total",
+			Help:      "Upstream requests resent after a transport error.",
+		}, []string{"rule"})},
+		upstreamCertErrors: counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_cert_errors_total",
+			Help:      "Upstream requests failed because the upstream TLS certificate could not be verified.",
+		}, []string{"rule", "reason"})},
+		socksErrors: counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "socks_errors_total",
+			Help:      "SOCKS dials failed, by whether the SOCKS server or the destination was at fault.",
+		}, []string{"rule", "reason"})},
+		endpointRequests: counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "endpoint_requests_total",
+			Help:      "Requests and tunnels sent to each SOCKS endpoint of a rule.",
+		}, []string{"rule", "endpoint"})},
+		patternMatches: counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rule_pattern_matches_total",
+			Help:      "Requests and tunnels routed by a rule, by the pattern of the rule that matched the destination.",
+		}, []string{"rule", "pattern"})},
+		responses: counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "responses_total",
+			Help:      "Responses sent to clients, by status code and whether the proxy or the upstream produced the status.",
+		}, []string{"rule", "code", "source"})},
+		requestBodySize: histogramVec{prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_body_bytes",
+			Help:      "Size of the request bodies read from clients, CONNECT tunnels excluded.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+		}, []string{"rule"})},
+		responseBodySize: histogramVec{prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "response_body_bytes",
+			Help:      "Size of the response bodies written to clients, CONNECT tunnels excluded.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+		}, []string{"rule"})},
+		bodyMatches: counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "response_body_matches_total",
+			Help:      "Occurrences of scan inspector patterns in response bodies.",
+		}, []string{"rule", "inspector"})},
+		circuitOpen: gaugeVec{prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "rule_circuit_open",
+			Help:      "1 while the circuit breaker of a rule is open and requests fall through to the next matching rule.",
+		}, []string{"rule"})},
+		ruleActive: gaugeVec{prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "rule_upstream_active",
+			Help:      "Requests and tunnels open to the upstream of a rule with a concurrency limit.",
+		}, []string{"rule"})},
+		decisionCache: counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "decision_cache_lookups_total",
+			Help:      "Lookups of block_private_networks decisions in the decision cache, by whether a fresh decision was found.",
+		}, []string{"result"})},
+		syslogDropped: counter{prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "audit_syslog_dropped_total",
+			Help:      "Audit records not shipped to syslog because the queue was full or the endpoint unreachable at shutdown.",
+		})},
+		auditDropped: counter{prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "audit_dropped_total",
+			Help:      "Audit records not written to the audit log because it was already closed at shutdown.",
+		})},
+		inboundConnsOpen: gauge{prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "inbound_connections_open",
+			Help:      "Client connections open on the proxy listeners, compared against the load_shedding watermarks.",
+		})},
+		loadShedding: gauge{prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "load_shedding",
+			Help:      "1 while open connections went above load_shedding.high_watermark and have not yet dropped below low_watermark.",
+		})},
+		loadShedRequests: counter{prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "load_shed_requests_total",
+			Help:      "Requests and tunnels answered with 503 because of load shedding.",
+		})},
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.inboundTTFB.vec,
+		m.inboundReceiveTime.vec,
+		m.inboundReadTimeouts.vec,
+		m.inboundConnRequests.vec,
+		m.inboundStreams.vec,
+		m.upstreamConns.vec,
+		m.upstreamRetries.vec,
+		m.upstreamCertErrors.vec,
+		m.socksErrors.vec,
+		m.endpointRequests.vec,
+		m.patternMatches.vec,
+		m.responses.vec,
+		m.requestBodySize.vec,
+		m.responseBodySize.vec,
+		m.bodyMatches.vec,
+		m.circuitOpen.vec,
+		m.ruleActive.vec,
+		m.decisionCache.vec,
+		m.syslogDropped.c,
+		m.auditDropped.c,
+		m.inboundConnsOpen.g,
+		m.loadShedding.g,
+		m.loadShedRequests.c,
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	if m.registry == nil {
+		return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+			http.Error(wr, "metrics are disabled by disable_metrics", http.StatusNotFound)
+		})
+	}
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *metrics) enabled() bool {
+	return m.registry != nil
+}
+
+// counterVec, histogramVec, gaugeVec, gauge and counter do nothing when their collector is nil, i.e. with disable_metrics.
+// They are concrete types rather than an interface with a no-op implementation: calling through an interface
+// would make the label values escape to the heap on every update.
+type counterVec struct{ vec *prometheus.CounterVec }
+
+func (v counterVec) inc(lvs ...string) {
+	if v.vec != nil {
+		v.vec.WithLabelValues(lvs...).Inc()
+	}
+}
+
+func (v counterVec) add(n float64, lvs ...string) {
+	if v.vec != nil {
+		v.vec.WithLabelValues(lvs...).Add(n)
+	}
+}
+
+type histogramVec struct{ vec *prometheus.HistogramVec }
+
+func (v histogramVec) observe(x float64, lvs ...string) {
+	if v.vec != nil {
+		v.vec.WithLabelValues(lvs...).Observe(x)
+	}
+}
+
+type gaugeVec struct{ vec *prometheus.GaugeVec }
+
+func (v gaugeVec) set(x float64, lvs ...string) {
+	if v.vec != nil {
+		v.vec.WithLabelValues(lvs...).Set(x)
+	}
+}
+
+func (v gaugeVec) add(x float64, lvs ...string) {
+	if v.vec != nil {
+		v.vec.WithLabelValues(lvs...).Add(x)
+	}
+}
+
+type gauge struct{ g prometheus.Gauge }
+
+func (g gauge) set(x float64) {
+	if g.g != nil {
+		g.g.Set(x)
+	}
+}
+
+type counter struct{ c prometheus.Counter }
+
+func (c counter) inc() {
+	if c.c != nil {
+		c.c.Inc()
+	}
+}
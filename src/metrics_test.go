@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+// recordRequest makes the metric updates of a proxied request through a SOCKS rule on a kept-alive connection.
+func recordRequest(m *metrics, rule string) {
+	m.inboundStreams.observe(1, "http/1.1")
+	m.patternMatches.inc(rule, "10.0.0.0/8")
+	m.endpointRequests.inc(rule, "10.1.0.1:1080")
+	m.upstreamConns.inc(rule, "true")
+	m.inboundTTFB.observe(0.002, rule)
+	m.inboundReceiveTime.observe(0.001, rule)
+	m.responses.inc(rule, "200", "upstream")
+	m.requestBodySize.observe(512, rule)
+	m.responseBodySize.observe(16<<10, rule)
+}
+
+func BenchmarkMetrics(b *testing.B) {
+	for _, bm := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"enabled", true},
+		{"disabled", false},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			m := newMetrics(bm.enabled)
+			b.ReportAllocs()
+			for b.Loop() {
+				recordRequest(m, "corp")
+			}
+		})
+	}
+}
+
+func TestDisabledMetricsDoNotAllocate(t *testing.T) {
+	m := newMetrics(false)
+	if allocs := testing.AllocsPerRun(100, func() { recordRequest(m, "corp") }); allocs != 0 {
+		t.Errorf("recording a request with disabled metrics allocated %v times, want 0", allocs)
+	}
+}
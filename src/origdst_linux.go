@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+)
+
+// originalDst returns the destination a connection had before an iptables REDIRECT/DNAT rule sent it to the proxy.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP connection: %T", conn)
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	var sysErr error
+	err = raw.Control(func(fd uintptr) {
+		if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+			var sa syscall.RawSockaddrInet6
+			size := uint32(unsafe.Sizeof(sa))
+			sysErr = getsockopt(fd, syscall.IPPROTO_IPV6, ip6tSoOriginalDst, unsafe.Pointer(&sa), &size)
+			port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+			addr = &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: int(port)}
+			return
+		}
+		var sa syscall.RawSockaddrInet4
+		size := uint32(unsafe.Sizeof(sa))
+		sysErr = getsockopt(fd, syscall.IPPROTO_IP, soOriginalDst, unsafe.Pointer(&sa), &size)
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+		addr = &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: int(port)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sysErr != nil {
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", sysErr)
+	}
+	return addr, nil
+}
+
+func getsockopt(fd uintptr, level, name int, val unsafe.Pointer, size *uint32) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(name), uintptr(val), uintptr(unsafe.Pointer(size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
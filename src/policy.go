@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+	"go.uber.org/zap"
+)
+
+// deny answers a request refused by proxy policy. Its status is configurable and kept apart
+// from the 502/504 of upstream failures, so clients and operators can tell blocked from broken.
+func (s *H2SProxyServer) deny(wr http.ResponseWriter, profile *domain.Profile, dest, reason string, keysAndValues ...any) {
+	s.logDenied(dest, reason, keysAndValues...)
+	http.Error(wr, fmt.Sprintf("%v: denied by proxy policy (%v)", dest, reason), profile.DenyStatus)
+}
+
+func (s *H2SProxyServer) logDenied(dest, reason string, keysAndValues ...any) {
+	s.logger.Warnw("request denied", append([]any{"destination", dest, "reason", reason}, keysAndValues...)...)
+}
+
+// denyReason returns why the profile refuses requests routed to rule, or "" when they are allowed.
+// A nil rule stands for requests matching no rule.
+func denyReason(profile *domain.Profile, rule *domain.Rule) string {
+	switch {
+	case rule == nil && profile.DenyUnmatched:
+		return "no matching rule"
+	case rule != nil && rule.ProxyType == domain.ProxyTypeDeny:
+		return "deny rule"
+	}
+	return ""
+}
+
+// blocksPrivateNetworks reports whether block_private_networks applies to requests routed to rule.
+func blocksPrivateNetworks(profile *domain.Profile, rule *domain.Rule) bool {
+	return profile.BlockPrivateNetworks && (rule == nil || !rule.AllowPrivateNetworks)
+}
+
+// privateDestination returns why block_private_networks refuses target for rule, and the address at fault, or "" when it
+// is allowed. A hostname is resolved, unless resolve_hostnames already did, and refused if any of its addresses is
+// private, or if it does not resolve: the upstream could reach an address the proxy cannot check.
+// With decision_cache_ttl, the answers for hostnames are cached by rule, host and port.
+func (s *H2SProxyServer) privateDestination(ctx context.Context, profile *domain.Profile, rule *domain.Rule, target *domain.Target) (string, string) {
+	if !blocksPrivateNetworks(profile, rule) {
+		return "", ""
+	}
+	ttl := time.Duration(profile.DecisionCacheTTL)
+	if ttl == 0 || net.ParseIP(target.Host) != nil {
+		// checking an address is cheaper than caching it
+		return s.checkPrivateDestination(ctx, profile, target)
+	}
+	key := decisionKey{rule: routeName(rule), host: target.Host, port: target.Port}
+	now := s.clock.Now()
+	if d, ok := s.decisions.get(key, now); ok {
+		s.metrics.decisionCache.inc("hit")
+		return d.addr, d.reason
+	}
+	s.metrics.decisionCache.inc("miss")
+	addr, reason := s.checkPrivateDestination(ctx, profile, target)
+	if reason != reasonUnresolvable {
+		// as with lookups, failures are not cached, so a DNS hiccup does not refuse the host for a whole TTL
+		s.decisions.put(key, decision{addr: addr, reason: reason}, now, ttl)
+	}
+	return addr, reason
+}
+
+const reasonUnresolvable = "destination not resolvable to check for private networks"
+
+// checkPrivateDestination is privateDestination without the decision cache.
+func (s *H2SProxyServer) checkPrivateDestination(ctx context.Context, profile *domain.Profile, target *domain.Target) (string, string) {
+	ips := target.IPs
+	if ip := net.ParseIP(target.Host); ip != nil {
+		ips = []net.IP{ip}
+	} else if len(ips) == 0 {
+		var err error
+		ips, err = s.resolver.lookup(ctx, dnsResolver(strings.Join(profile.DNSServers, ",")), target.Host, time.Duration(profile.ResolveCacheTTL), profile.ResolveConcurrency)
+		if err != nil {
+			return "", reasonUnresolvable
+		}
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return ip.String(), "private network destination"
+		}
+	}
+	return "", ""
+}
+
+// isPrivateIP reports whether ip is loopback, link-local, unspecified, an RFC 1918 address or an IPv6 unique local address.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// refusePrivateDial is the net.Dialer Control of direct routes under block_private_networks. It checks the address
+// actually dialed, so a hostname resolving to a private address after privateDestination checked it is still refused.
+func refusePrivateDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && isPrivateIP(ip) {
+		return errors.New("private network destination refused by block_private_networks")
+	}
+	return nil
+}
+
+// upstreamError answers a request the upstream failed to serve.
+func (s *H2SProxyServer) upstreamError(wr http.ResponseWriter, log *zap.SugaredLogger, profile *domain.Profile, matched *domain.Rule, dest string, err error) {
+	rule := routeName(matched)
+	if reason, ok := certErrorReason(err); ok {
+		status := profile.CertErrorStatus
+		s.metrics.upstreamCertErrors.inc(rule, reason)
+		log.Errorw("upstream certificate verification failed", "destination", dest, "rule", rule, "reason", reason, "status", status, "error", err)
+		msg := "upstream certificate verification failed (" + reason + ")"
+		if profile.ExposeUpstreamErrors || s.logger.Desugar().Core().Enabled(zap.DebugLevel) {
+			// the certificate details help debugging but should not reach clients in production
+			msg += ": " + err.Error()
+		}
+		http.Error(wr, msg, status)
+		return
+	}
+	status := upstreamStatus(err)
+	if s.reportSOCKSError(log, rule, dest, err) {
+		http.Error(wr, http.StatusText(status)+s.socksDetail(err)+errorDetail(profile, err), status)
+		return
+	}
+	if isResponseHeaderTimeout(err) {
+		log.Errorw("upstream sent no response headers within response_header_timeout", "destination", dest, "rule", rule,
+			"timeout", profile.ResponseHeaderTimeoutFor(matched), "status", status)
+		http.Error(wr, http.StatusText(status)+errorDetail(profile, err), status)
+		return
+	}
+	log.Errorw("upstream request failed", "destination", dest, "status", status, "error", err)
+	http.Error(wr, http.StatusText(status)+errorDetail(profile, err), status)
+}
+
+// errorDetail returns err to append to an error response when expose_upstream_errors is set, and nothing otherwise.
+func errorDetail(profile *domain.Profile, err error) string {
+	if !profile.ExposeUpstreamErrors {
+		return ""
+	}
+	return ": " + err.Error()
+}
+
+// certErrorReason reports whether err is a failed verification of the upstream TLS certificate, and why.
+func certErrorReason(err error) (string, bool) {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		verification     *tls.CertificateVerificationError
+	)
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "unknown_authority", true
+	case errors.As(err, &hostname):
+		return "hostname_mismatch", true
+	case errors.As(err, &invalid):
+		if invalid.Reason == x509.Expired {
+			return "expired", true
+		}
+		return "invalid", true
+	case errors.As(err, &verification):
+		return "invalid", true
+	}
+	return "", false
+}
+
+// isResponseHeaderTimeout reports whether err is the transport giving up on the response headers.
+// net/http does not export the error, only its message.
+func isResponseHeaderTimeout(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "timeout awaiting response headers")
+}
+
+// exceededDeadline reports whether req ran past max_request_duration.
+func exceededDeadline(req *http.Request) bool {
+	return errors.Is(req.Context().Err(), context.DeadlineExceeded)
+}
+
+// upstreamStatus is 504 when the upstream timed out, 503 when the rule is at its concurrency limit
+// and 502 for any other failure.
+func upstreamStatus(err error) int {
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	if errors.Is(err, errConcurrencyLimit) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// pprofHandler serves the runtime profiles of net/http/pprof under /debug/pprof/, behind the admin token when one is set.
+// It is mounted on its own mux: importing net/http/pprof also registers the handlers on http.DefaultServeMux,
+// which no listener of the proxy serves.
+func (s *H2SProxyServer) pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return s.adminAuth(mux)
+}
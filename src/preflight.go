@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+// preflight dials every SOCKS endpoint of the profile once, concurrently and within timeout, and logs which are reachable.
+// It fails if a critical rule has no reachable endpoint. Only a TCP connection is made, no SOCKS handshake.
+func (s *H2SProxyServer) preflight(timeout time.Duration) error {
+	profile := s.profile.Load()
+	reachable := make(map[spareKey]bool)
+	for i := range profile.Rules {
+		rule := &profile.Rules[i]
+		if rule.ProxyType != domain.ProxyTypeSOCKS5 {
+			continue
+		}
+		for _, ep := range rule.Endpoints {
+			reachable[spareKey{proxyAddr: ep.Addr(), sourceIP: rule.SourceIP, network: rule.Network}] = false
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for key := range reachable {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := baseDialer(key.sourceIP, strings.Join(profile.DNSServers, ",")).DialContext(ctx, key.network, key.proxyAddr)
+			if err != nil {
+				s.logger.Warnw("preflight: endpoint unreachable", "proxyAddr", key.proxyAddr, "sourceIP", key.sourceIP, "error", err)
+				return
+			}
+			conn.Close()
+			s.logger.Infow("preflight: endpoint reachable", "proxyAddr", key.proxyAddr, "sourceIP", key.sourceIP)
+			mu.Lock()
+			reachable[key] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	var down []string
+	for i := range profile.Rules {
+		rule := &profile.Rules[i]
+		if !rule.Critical || rule.ProxyType != domain.ProxyTypeSOCKS5 {
+			continue
+		}
+		up := false
+		for _, ep := range rule.Endpoints {
+			up = up || reachable[spareKey{proxyAddr: ep.Addr(), sourceIP: rule.SourceIP, network: rule.Network}]
+		}
+		if !up {
+			down = append(down, rule.Name)
+		}
+	}
+	if len(down) > 0 {
+		return fmt.Errorf("no reachable endpoint for critical rules: %v", strings.Join(down, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// notifyReady tells the process manager that every listener is bound and accepting connections:
+// systemd through $NOTIFY_SOCKET, and s6-style supervisors by writing a newline to readyFD and closing it.
+// Each mechanism is skipped when it is not configured, and failures are only logged.
+func (s *H2SProxyServer) notifyReady() {
+	if addr := os.Getenv("NOTIFY_SOCKET"); addr != "" {
+		if err := sdNotify(addr, "READY=1"); err != nil {
+			s.logger.Warnw("failed to notify systemd of readiness", "socket", addr, "error", err)
+		} else {
+			s.logger.Infow("notified systemd of readiness", "socket", addr)
+		}
+	}
+	if s.readyFD > 0 {
+		f := os.NewFile(uintptr(s.readyFD), "ready-fd")
+		_, err := f.Write([]byte("\n"))
+		f.Close()
+		if err != nil {
+			s.logger.Warnw("failed to signal readiness on file descriptor", "fd", s.readyFD, "error", err)
+		} else {
+			s.logger.Infow("signaled readiness on file descriptor", "fd", s.readyFD)
+		}
+	}
+}
+
+// sdNotify sends state to the systemd notify socket at addr. A leading '@' names an abstract socket.
+func sdNotify(addr, state string) error {
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// hostResolver caches the addresses hostnames resolved to, for matching rules and checking destinations against them.
+// It bounds the lookups in flight, so a flood of unique hostnames queues instead of starting a lookup each,
+// and concurrent lookups of one host share a single query.
+type hostResolver struct {
+	mu      sync.Mutex
+	entries map[string]resolvedHost
+	calls   map[string]*resolveCall
+	sem     chan struct{} // a slot per lookup in flight, remade when resolve_concurrency changes
+	clock   Clock
+}
+
+type resolvedHost struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// resolveCall is a lookup in flight, done is closed once ips and err are set.
+type resolveCall struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+func newHostResolver(clock Clock) *hostResolver {
+	return &hostResolver{entries: make(map[string]resolvedHost), calls: make(map[string]*resolveCall), clock: clock}
+}
+
+// lookup returns the A and AAAA records of host, cached for ttl. Failed lookups are not cached.
+// At most concurrency lookups run at once; callers beyond that wait for a slot until ctx is done.
+func (r *hostResolver) lookup(ctx context.Context, resolver *net.Resolver, host string, ttl time.Duration, concurrency int) ([]net.IP, error) {
+	now := r.clock.Now()
+	r.mu.Lock()
+	if e, ok := r.entries[host]; ok && now.Before(e.expires) {
+		r.mu.Unlock()
+		return e.ips, nil
+	}
+	call, ok := r.calls[host]
+	if !ok {
+		call = &resolveCall{done: make(chan struct{})}
+		r.calls[host] = call
+		if cap(r.sem) != concurrency {
+			r.sem = make(chan struct{}, concurrency)
+		}
+		go r.resolve(resolver, host, ttl, call, r.sem)
+	}
+	r.mu.Unlock()
+	select {
+	case <-call.done:
+		return call.ips, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve runs the lookup of call once sem has a free slot. It is detached from the requests waiting for it,
+// so one of them giving up does not fail the others, and is bounded by resolveTimeout instead.
+func (r *hostResolver) resolve(resolver *net.Resolver, host string, ttl time.Duration, call *resolveCall, sem chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	select {
+	case sem <- struct{}{}:
+		var addrs []net.IPAddr
+		addrs, call.err = resolver.LookupIPAddr(ctx, host)
+		<-sem
+		for _, a := range addrs {
+			call.ips = append(call.ips, a.IP)
+		}
+	case <-ctx.Done():
+		call.err = ctx.Err()
+	}
+	now := r.clock.Now()
+	r.mu.Lock()
+	delete(r.calls, host)
+	if call.err == nil {
+		// drop expired entries now and then so the cache does not grow with every name ever requested
+		if len(r.entries) >= resolveCacheSweepSize {
+			for h, e := range r.entries {
+				if !now.Before(e.expires) {
+					delete(r.entries, h)
+				}
+			}
+		}
+		r.entries[host] = resolvedHost{ips: call.ips, expires: now.Add(ttl)}
+	}
+	r.mu.Unlock()
+	close(call.done)
+}
+
+const (
+	resolveCacheSweepSize = 4096
+	// resolveTimeout bounds a lookup including its wait for a slot, so stuck queries cannot hold slots for long
+	resolveTimeout = 10 * time.Second
+)
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// statusRecorder remembers the status and body size written to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	upstream bool  // the status was relayed from the upstream rather than generated by the proxy
+	written  int64 // body bytes
+}
+
+// writeUpstreamHeader relays the status of the upstream response.
+func (w *statusRecorder) writeUpstreamHeader(status int) {
+	w.upstream = true
+	w.WriteHeader(status)
+}
+
+// source labels where the response status came from, for metrics.
+func (w *statusRecorder) source() string {
+	if w.upstream {
+		return "upstream"
+	}
+	return "proxy"
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Hijack is used by CONNECT, which answers 200 on the hijacked connection.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		w.status = http.StatusOK
+	}
+	return conn, brw, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+	"go.uber.org/zap"
+)
+
+// doWithRetry sends req, resending it after transport errors, and after 429 and 503 responses with a Retry-After
+// the request can wait for, as the retry policy allows. Requests whose body could not be buffered are sent once.
+func (s *H2SProxyServer) doWithRetry(client *http.Client, req *http.Request, retry domain.Retry, maxBody int64, rule string, log *zap.SugaredLogger) (*http.Response, error) {
+	if !retry.Allows(req.Method) || isGRPC(req) {
+		// gRPC streams must not be buffered
+		return client.Do(req)
+	}
+	replayable, err := bufferBody(req, maxBody)
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		log.Debugw("request body too large to buffer, not retrying", "rule", rule, "url", req.URL)
+		return client.Do(req)
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := client.Do(req)
+		if attempt >= *retry.Attempts || req.Context().Err() != nil {
+			return res, err
+		}
+		delay := time.Duration(*retry.Backoff)
+		if err == nil {
+			var ok bool
+			if delay, ok = s.retryAfter(req, res, time.Duration(*retry.MaxRetryAfter)); !ok {
+				return res, nil
+			}
+			log.Warnw("retrying upstream request after Retry-After", "rule", rule, "url", req.URL, "attempt", attempt+1,
+				"status", res.StatusCode, "delay", delay)
+			// drain a little so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+			res.Body.Close()
+		} else {
+			if _, ok := certErrorReason(err); ok {
+				// the same certificate would be rejected again
+				return res, err
+			}
+			log.Warnw("retrying upstream request", "rule", rule, "url", req.URL, "attempt", attempt+1, "error", err)
+		}
+		s.metrics.upstreamRetries.inc(rule)
+		select {
+		case <-s.clock.After(delay):
+		case <-req.Context().Done():
+			if err == nil {
+				err = req.Context().Err()
+			}
+			return nil, err
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// retryAfter returns how long to wait before resending req after res, when res is a 429 or 503 asking to retry
+// no later than limit and before the request's deadline.
+func (s *H2SProxyServer) retryAfter(req *http.Request, res *http.Response, limit time.Duration) (time.Duration, bool) {
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	now := s.clock.Now()
+	delay, ok := parseRetryAfter(res.Header.Get("Retry-After"), now)
+	if !ok || delay > limit {
+		return 0, false
+	}
+	if deadline, ok := req.Context().Deadline(); ok && now.Add(delay).After(deadline) {
+		return 0, false
+	}
+	return delay, true
+}
+
+// parseRetryAfter reads a Retry-After value in either of its forms, delay-seconds or an HTTP-date.
+// A date in the past means no delay.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseUint(v, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
+
+// bufferBody reads a request body of at most limit bytes into memory and sets GetBody so
+// it can be sent again. Larger bodies keep streaming and are reported as not replayable.
+func bufferBody(req *http.Request, limit int64) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+	if req.ContentLength > limit {
+		return false, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(buf)) > limit {
+		// chunked body larger than the limit: put back what was read and stream the rest
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return false, nil
+	}
+	req.ContentLength = int64(len(buf))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+type H2SProxyServer struct {
+	profilePath string
+	profile     atomic.Pointer[domain.Profile]
+	reloadMu    sync.Mutex
+	logger      *zap.SugaredLogger
+	metrics     *metrics
+	transports  *transportCache
+	copyBuffers *copyBuffers
+	tracer      trace.Tracer
+	clock       Clock
+	resolver    *hostResolver
+	decisions   *decisionCache
+	breakers    *breakers
+	limits      *ruleLimits
+	audit       *auditLog     // nil unless audit_log.path is set
+	syslog      *syslogWriter // nil unless audit_log.syslog.addr is set
+	stats       *requestStats
+	inflight    *inflightRegistry
+	maintenance *maintenance
+	shedder     *loadShedder
+	started     time.Time
+	readyFD     int    // written to and closed once listening, when positive
+	listen      string // --listen or $H2S_PROXY_LISTEN, applied again to every reloaded profile
+
+	debugRequests atomic.Uint64    // requests counted by debug_log_sampling
+	auditRequests [5]atomic.Uint64 // requests counted by audit_log.sampling, by status class
+
+	levelLoggers sync.Map // loggers of rules with a log_level, by zapcore.Level
+}
+
+func NewH2SProxyServer(profilePath string, profile *domain.Profile, logger *zap.SugaredLogger) *H2SProxyServer {
+	s := &H2SProxyServer{
+		profilePath: profilePath,
+		logger:      logger,
+		metrics:     newMetrics(!profile.DisableMetrics),
+		transports:  newTransportCache(),
+		copyBuffers: newCopyBuffers(),
+		tracer:      noop.NewTracerProvider().Tracer(tracerName),
+		clock:       realClock{},
+		breakers:    newBreakers(),
+		limits:      newRuleLimits(),
+		stats:       newRequestStats(),
+		inflight:    newInflightRegistry(),
+		maintenance: &maintenance{logger: logger},
+	}
+	s.resolver = newHostResolver(s.clock)
+	s.decisions = newDecisionCache()
+	s.shedder = &loadShedder{profile: s.profile.Load, logger: logger, metrics: s.metrics}
+	s.profile.Store(profile)
+	return s
+}
+
+func (s *H2SProxyServer) Run() error {
+	s.started = s.clock.Now()
+	profile := s.profile.Load()
+	tp, shutdownTracing, err := newTracerProvider(profile.Tracing, userAgent(profile))
+	if err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			s.logger.Errorf("failed to flush spans: %v", err)
+		}
+	}()
+	s.tracer = tp.Tracer(tracerName)
+
+	if profile.AuditLog.Path != "" {
+		audit, err := openAuditLog(profile.AuditLog, s.metrics)
+		if err != nil {
+			return fmt.Errorf("audit log: %w", err)
+		}
+		defer audit.Close()
+		s.audit = audit
+	}
+	if cfg := profile.AuditLog.Syslog; cfg.Addr != "" {
+		s.syslog = newSyslogWriter(cfg, s.logger, s.metrics)
+		defer s.syslog.Close(shutdownTimeout)
+		s.logger.Infow("shipping audit records to syslog", "addr", cfg.Addr, "network", cfg.Network)
+	}
+
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, addr := range profile.GetServerAddrs() {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, &inboundListener{Listener: ln, metrics: s.metrics, shedder: s.shedder})
+	}
+
+	servers := make([]*http.Server, 0, len(listeners)+1)
+	for range listeners {
+		servers = append(servers, s.proxyServer(profile))
+	}
+
+	if addr := profile.Admin.Addr; addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		switch {
+		case err == nil:
+			listeners = append(listeners, ln)
+			servers = append(servers, &http.Server{Handler: s.adminHandler()})
+			s.logger.Infof("admin server listening [%v]", addr)
+		case profile.Admin.OnBindError == domain.AdminBindContinue:
+			s.logger.Warnw("admin server failed to start, continuing without metrics and admin endpoints", "addr", addr, "error", err)
+		default:
+			s.logger.Errorw("admin server failed to start, aborting startup", "addr", addr, "error", err)
+			closeAll()
+			return fmt.Errorf("admin: %w", err)
+		}
+	}
+
+	if cfg := profile.Pprof; cfg.Enabled {
+		ln, err := net.Listen("tcp", cfg.Addr)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("pprof: %w", err)
+		}
+		listeners = append(listeners, ln)
+		servers = append(servers, &http.Server{Handler: s.pprofHandler()})
+		s.logger.Warnf("pprof server listening [%v], only expose it to trusted operators", cfg.Addr)
+	}
+
+	warmupCtx, stopWarmup := context.WithCancel(context.Background())
+	defer stopWarmup()
+	if s.transports.stub {
+		s.logger.Warnw("test mode: every upstream is stubbed and answers with the request it received, do not use in production")
+	} else {
+		go s.warmup(warmupCtx)
+	}
+	go s.watchMaintenanceFile(warmupCtx)
+	go s.sweepIdleConns(warmupCtx)
+
+	errCh := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		go func() {
+			errCh <- servers[i].Serve(ln)
+		}()
+	}
+	s.notifyReady()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+wait:
+	for {
+		select {
+		case err = <-errCh:
+			break wait
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				if _, rerr := s.reload(); rerr != nil {
+					s.logger.Errorf("failed to reload profile: %v", rerr)
+				}
+				continue
+			}
+			s.logger.Infof("received signal %v, shutting down", sig)
+			break wait
+		}
+	}
+
+	// all listeners share a lifetime: once one stops, stop the rest
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if serr := srv.Shutdown(ctx); serr != nil {
+			s.logger.Errorf("failed to shutdown server: %v", serr)
+		}
+	}
+	if path := s.profile.Load().StatsFile; path != "" {
+		if serr := s.writeStatsFile(path); serr != nil {
+			s.logger.Errorf("failed to write stats file: %v", serr)
+		} else {
+			s.logger.Infow("wrote request stats", "path", path)
+		}
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// proxyServer returns the server of a proxy listener, which must be an inboundListener.
+func (s *H2SProxyServer) proxyServer(profile *domain.Profile) *http.Server {
+	// h2c lets clients such as gRPC speak HTTP/2 to the proxy without TLS
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{
+		Handler:           http.HandlerFunc(s.proxyHandler),
+		ReadHeaderTimeout: time.Duration(profile.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(profile.ReadTimeout),
+		ConnContext:       withInboundConn,
+		Protocols:         protocols,
+	}
+}
+
+// reload re-reads the profile and swaps it in atomically.
+// Requests already in flight finish with the profile they started with.
+// Listen addresses, timeouts, tracing and the audit log are only read at startup.
+func (s *H2SProxyServer) reload() (*domain.Profile, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	profile, migratedFrom, err := loadProfile(s.profilePath, s.listen)
+	if err != nil {
+		return nil, err
+	}
+	logMigration(s.logger, s.profilePath, migratedFrom)
+	s.profile.Store(profile)
+	s.decisions.clear()
+	s.logger.Infow("profile reloaded", "path", s.profilePath, "rules", len(profile.Rules))
+	s.drainTransports(profile)
+	return profile, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+	"go.uber.org/zap"
+)
+
+// loadShedder counts the open inbound connections and turns load shedding on above load_shedding.high_watermark,
+// and off again only once they drop below low_watermark, so the proxy does not flap around a single limit.
+type loadShedder struct {
+	conns    atomic.Int64
+	shedding atomic.Bool
+	mu       sync.Mutex // serializes transitions, so each is logged once
+
+	profile func() *domain.Profile
+	logger  *zap.SugaredLogger
+	metrics *metrics
+}
+
+func (l *loadShedder) opened() { l.update(l.conns.Add(1)) }
+func (l *loadShedder) closed() { l.update(l.conns.Add(-1)) }
+
+// update applies the watermarks of the current profile to n open connections.
+func (l *loadShedder) update(n int64) {
+	l.metrics.inboundConnsOpen.set(float64(n))
+	cfg := l.profile().LoadShedding
+	shedding := l.shedding.Load()
+	enter := !shedding && cfg.HighWatermark > 0 && n > int64(cfg.HighWatermark)
+	// a reload turning shedding off ends it right away
+	leave := shedding && (cfg.HighWatermark == 0 || n < int64(cfg.LowWatermark))
+	if !enter && !leave {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.shedding.Load() != shedding {
+		return // another connection made the transition first
+	}
+	l.shedding.Store(enter)
+	if enter {
+		l.metrics.loadShedding.set(1)
+		l.logger.Warnw("entering load shedding, new requests get 503", "connections", n, "highWatermark", cfg.HighWatermark, "lowWatermark", cfg.LowWatermark)
+	} else {
+		l.metrics.loadShedding.set(0)
+		l.logger.Infow("leaving load shedding", "connections", n, "lowWatermark", cfg.LowWatermark)
+	}
+}
+
+// shed answers req with 503 while load shedding is on, and reports whether it did. The connection is closed
+// after the response, as shedding only ends once clients let go of connections.
+func (l *loadShedder) shed(wr http.ResponseWriter, req *http.Request) bool {
+	if !l.shedding.Load() {
+		return false
+	}
+	l.metrics.loadShedRequests.inc()
+	if req.ProtoMajor == 1 {
+		wr.Header().Set("Connection", "close")
+	}
+	http.Error(wr, "proxy overloaded, try again later", http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadSheddingHysteresis(t *testing.T) {
+	s := newTestServer(t, `{"version": 2, "listen_addrs": ["127.0.0.1:0"], "load_shedding": {"high_watermark": 10}}`)
+	l := s.shedder
+	// low_watermark defaults to 9
+	steps := []struct {
+		open     int
+		shedding bool
+	}{
+		{10, false},
+		{11, true},
+		{10, true},
+		{9, true},
+		{8, false},
+		{10, false},
+		{11, true},
+	}
+	open := 0
+	for _, step := range steps {
+		for open < step.open {
+			l.opened()
+			open++
+		}
+		for open > step.open {
+			l.closed()
+			open--
+		}
+		if got := l.shedding.Load(); got != step.shedding {
+			t.Errorf("%v connections open: shedding %v, want %v", open, got, step.shedding)
+		}
+		want := 0.0
+		if step.shedding {
+			want = 1
+		}
+		if got := testutil.ToFloat64(s.metrics.loadShedding.g); got != want {
+			t.Errorf("%v connections open: load_shedding gauge %v, want %v", open, got, want)
+		}
+		if got := testutil.ToFloat64(s.metrics.inboundConnsOpen.g); got != float64(open) {
+			t.Errorf("inbound_connections_open gauge %v, want %v", got, open)
+		}
+	}
+}
+
+func TestLoadSheddingSmallHighWatermark(t *testing.T) {
+	// 90% of 1 rounds down to 0, which the count could never drop below
+	s := newTestServer(t, `{"version": 2, "listen_addrs": ["127.0.0.1:0"], "load_shedding": {"high_watermark": 1}}`)
+	if low := s.profile.Load().LoadShedding.LowWatermark; low != 1 {
+		t.Fatalf("low_watermark defaulted to %v, want 1", low)
+	}
+	l := s.shedder
+	l.opened()
+	l.opened()
+	if !l.shedding.Load() {
+		t.Fatal("2 connections open over a high watermark of 1: not shedding")
+	}
+	l.closed()
+	l.closed()
+	if l.shedding.Load() {
+		t.Error("every connection closed: still shedding")
+	}
+}
+
+func TestLoadSheddingResponse(t *testing.T) {
+	s := newTestServer(t, `{"version": 2, "listen_addrs": ["127.0.0.1:0"], "load_shedding": {"high_watermark": 1}}`)
+	for range 2 {
+		s.shedder.opened()
+	}
+	rec := httptest.NewRecorder()
+	s.proxyHandler(rec, httptest.NewRequest(http.MethodGet, "http://a.example/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Connection") != "close" {
+		t.Errorf("got %v with Connection %q, want 503 closing the connection", rec.Code, rec.Header().Get("Connection"))
+	}
+	if got := testutil.ToFloat64(s.metrics.loadShedRequests.c); got != 1 {
+		t.Errorf("load_shed_requests_total %v, want 1", got)
+	}
+}
+
+func TestLoadSheddingCountsConnections(t *testing.T) {
+	s, ts := newTestProxy(t, `{"version": 2, "listen_addrs": ["127.0.0.1:0"], "load_shedding": {"high_watermark": 2, "low_watermark": 1}}`)
+	s.transports.stub = true
+	addr := ts.Listener.Addr().String()
+	probe := func() int {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET http://a.example/ HTTP/1.1\r\nHost: a.example\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	waitOpen := func(n int64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); s.shedder.conns.Load() != n; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v connections counted, want %v", s.shedder.conns.Load(), n)
+			}
+		}
+	}
+
+	var idle []net.Conn
+	for range 2 {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		idle = append(idle, conn)
+	}
+	waitOpen(2)
+	if got := probe(); got != http.StatusServiceUnavailable {
+		t.Fatalf("third connection over a high watermark of 2: got %v, want 503", got)
+	}
+	idle[1].Close()
+	waitOpen(1)
+	if got := probe(); got != http.StatusServiceUnavailable {
+		t.Fatalf("1 idle connection, not below the low watermark: got %v, want 503", got)
+	}
+	idle[0].Close()
+	waitOpen(0)
+	if got := probe(); got != http.StatusOK {
+		t.Fatalf("below the low watermark: got %v, want 200", got)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errHelloCaptured = errors.New("client hello captured")
+
+// peekServerName reads a TLS ClientHello from r and returns its SNI along with a reader
+// that replays every byte consumed from r, so the stream can be forwarded untouched.
+//
+// The ClientHello is parsed by running a server handshake from crypto/tls over a
+// read-only connection and aborting it once the hello has been seen.
+func peekServerName(r io.Reader) (string, io.Reader, error) {
+	var peeked bytes.Buffer
+	var serverName string
+	err := tls.Server(readOnlyConn{r: io.TeeReader(r, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloCaptured
+		},
+	}).Handshake()
+	replay := io.MultiReader(&peeked, r)
+	if errors.Is(err, errHelloCaptured) {
+		return serverName, replay, nil
+	}
+	return "", replay, err
+}
+
+// readOnlyConn feeds a reader to crypto/tls and discards anything the handshake tries to write.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Reasons a SOCKS dial failed, used as the reason label of socks_errors_total.
+const (
+	socksServerUnreachable = "server_unreachable" // the SOCKS server itself could not be reached
+	socksAuthFailed        = "auth_failed"
+	socksRejected          = "rejected"           // the ruleset of the SOCKS server refused the destination
+	socksTargetUnreachable = "target_unreachable" // the SOCKS server could not reach the destination
+	socksServerFailure     = "server_failure"
+	socksHandshakeFailed   = "handshake_failed" // malformed or interrupted handshake
+)
+
+var socksMessages = map[string]string{
+	socksServerUnreachable: "SOCKS server unreachable",
+	socksAuthFailed:        "SOCKS authentication failed",
+	socksRejected:          "SOCKS server refused the destination",
+	socksTargetUnreachable: "destination unreachable from the SOCKS server",
+	socksServerFailure:     "SOCKS server failure",
+	socksHandshakeFailed:   "SOCKS handshake failed",
+}
+
+// socksError is a failed SOCKS dial, classified by whether the SOCKS server or the destination is at fault.
+type socksError struct {
+	reason string
+	err    error
+}
+
+func (e *socksError) Error() string { return e.err.Error() }
+
+func (e *socksError) Unwrap() error { return e.err }
+
+// socksServerDialer marks the failures to connect to the SOCKS server, before any handshake.
+type socksServerDialer struct {
+	spareDialer
+}
+
+func (d socksServerDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := d.spareDialer.DialContext(ctx, network, addr)
+	if err != nil && ctx.Err() == nil {
+		return nil, &socksError{reason: socksServerUnreachable, err: err}
+	}
+	return c, err
+}
+
+func (d socksServerDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// classifySOCKS wraps the errors of a SOCKS dial in a socksError. Errors caused by ctx are left as they are.
+func classifySOCKS(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err == nil || ctx.Err() != nil {
+			return c, err
+		}
+		var se *socksError
+		if errors.As(err, &se) {
+			return nil, err
+		}
+		if reason := socksReason(err); reason != "" {
+			return nil, &socksError{reason: reason, err: err}
+		}
+		return nil, err
+	}
+}
+
+// socksReason classifies a handshake error of golang.org/x/net/proxy, which only reports them as text.
+func socksReason(err error) string {
+	var op *net.OpError
+	if !errors.As(err, &op) || op.Op != "socks connect" || op.Err == nil {
+		return ""
+	}
+	var ne net.Error
+	if errors.As(op.Err, &ne) && ne.Timeout() {
+		return ""
+	}
+	msg := op.Err.Error()
+	if reply, ok := strings.CutPrefix(msg, "unknown error "); ok {
+		// the reply code of the SOCKS server, see RFC 1928 section 6
+		switch reply {
+		case "connection not allowed by ruleset":
+			return socksRejected
+		case "network unreachable", "host unreachable", "connection refused", "TTL expired":
+			return socksTargetUnreachable
+		}
+		return socksServerFailure
+	}
+	switch msg {
+	case "username/password authentication failed", "no acceptable authentication methods", "invalid username/password":
+		return socksAuthFailed
+	}
+	return socksHandshakeFailed
+}
+
+// reportSOCKSError logs and counts err and reports whether it is a SOCKS failure.
+func (s *H2SProxyServer) reportSOCKSError(log *zap.SugaredLogger, rule, dest string, err error) bool {
+	var se *socksError
+	if !errors.As(err, &se) {
+		return false
+	}
+	s.metrics.socksErrors.inc(rule, se.reason)
+	log.Errorw(socksMessages[se.reason], "destination", dest, "rule", rule, "reason", se.reason, "error", err)
+	return true
+}
+
+// socksDetail returns the classification of a SOCKS failure to append to the error response.
+// Like certificate details, it is only sent to clients in debug mode.
+func (s *H2SProxyServer) socksDetail(err error) string {
+	var se *socksError
+	if !errors.As(err, &se) || !s.logger.Desugar().Core().Enabled(zap.DebugLevel) {
+		return ""
+	}
+	return " (socks: " + se.reason + ")"
+}
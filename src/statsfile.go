@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// statsSummary is the content of stats_file: what the proxy routed between startup and shutdown.
+type statsSummary struct {
+	Started  time.Time             `json:"started"`
+	Stopped  time.Time             `json:"stopped"`
+	Requests int64                 `json:"requests"`
+	Rules    map[string]*ruleStats `json:"rules"` // by rule name, with "default" and "none" for refusals before matching
+}
+
+// writeStatsFile writes the request counts of the process to path as JSON, replacing the file in one rename
+// so readers never see half of it.
+func (s *H2SProxyServer) writeStatsFile(path string) error {
+	summary := statsSummary{Started: s.started, Stopped: s.clock.Now(), Rules: map[string]*ruleStats{}}
+	s.stats.mu.Lock()
+	summary.Requests = s.stats.total
+	for rule, rs := range s.stats.byRule {
+		copied := *rs
+		summary.Rules[rule] = &copied
+	}
+	s.stats.mu.Unlock()
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
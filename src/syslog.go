@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+	"go.uber.org/zap"
+)
+
+const (
+	syslogDialTimeout   = 5 * time.Second
+	syslogWriteTimeout  = 5 * time.Second
+	syslogRetryInterval = time.Second
+	// facility local0, severity informational, see RFC 5424 section 6.2.1
+	syslogPriority = 16*8 + 6
+)
+
+// syslogWriter ships audit records to a syslog endpoint from a goroutine, so a slow or unreachable
+// endpoint never holds up requests: records are queued in a bounded buffer and dropped once it is full.
+type syslogWriter struct {
+	cfg      domain.Syslog
+	hostname string
+	logger   *zap.SugaredLogger
+	metrics  *metrics
+
+	mu     sync.Mutex // guards closed, so records of tunnels outliving shutdown are not sent on a closed channel
+	closed bool
+	lines  chan []byte
+	stop   chan struct{} // closed to give up on a record that cannot be delivered
+	done   chan struct{}
+}
+
+func newSyslogWriter(cfg domain.Syslog, logger *zap.SugaredLogger, m *metrics) *syslogWriter {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	w := &syslogWriter{
+		cfg:      cfg,
+		hostname: hostname,
+		logger:   logger,
+		metrics:  m,
+		lines:    make(chan []byte, cfg.BufferSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// send queues one JSON record without blocking. Records sent after Close are dropped.
+func (w *syslogWriter) send(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		w.metrics.syslogDropped.inc()
+		return
+	}
+	select {
+	case w.lines <- line:
+	default:
+		w.metrics.syslogDropped.inc()
+	}
+}
+
+func (w *syslogWriter) run() {
+	defer close(w.done)
+	var conn net.Conn
+	failing := false // logged once per outage rather than on every retry
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for line := range w.lines {
+		msg := w.format(line)
+		for {
+			var err error
+			if conn == nil {
+				conn, err = net.DialTimeout(w.cfg.Network, w.cfg.Addr, syslogDialTimeout)
+			}
+			if err == nil {
+				conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+				if _, err = conn.Write(msg); err == nil {
+					if failing {
+						w.logger.Infow("shipping audit records to syslog again", "addr", w.cfg.Addr)
+						failing = false
+					}
+					break
+				}
+				conn.Close()
+				conn = nil
+			}
+			if !failing {
+				w.logger.Warnw("failed to ship audit records to syslog, queueing them and retrying", "addr", w.cfg.Addr, "error", err)
+				failing = true
+			}
+			select {
+			case <-w.stop:
+				w.metrics.syslogDropped.inc()
+				return
+			case <-time.After(syslogRetryInterval):
+			}
+		}
+	}
+}
+
+// format frames line as an RFC 5424 message, terminated by a newline for stream transports.
+func (w *syslogWriter) format(line []byte) []byte {
+	msg := fmt.Appendf(nil, "<%d>1 %s %s %s - - - ", syslogPriority, time.Now().UTC().Format(time.RFC3339Nano), w.hostname, w.cfg.Tag)
+	msg = append(msg, line...)
+	if w.cfg.Network == "tcp" {
+		msg = append(msg, '\n')
+	}
+	return msg
+}
+
+// Close delivers the queued records, giving up after timeout when the endpoint is unreachable.
+func (w *syslogWriter) Close(timeout time.Duration) {
+	w.mu.Lock()
+	w.closed = true
+	close(w.lines)
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+	case <-time.After(timeout):
+		close(w.stop)
+		<-w.done
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+	"go.uber.org/zap"
+)
+
+func TestSyslogWriterSendAfterClose(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	cfg := domain.Syslog{Addr: pc.LocalAddr().String(), Network: "udp", Tag: "test", BufferSize: 4}
+	w := newSyslogWriter(cfg, zap.NewNop().Sugar(), newMetrics(false))
+	w.send([]byte(`{"status":200}`))
+	w.Close(time.Second)
+
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("record queued before Close not delivered: %v", err)
+	}
+	if !bytes.HasSuffix(buf[:n], []byte(` test - - - {"status":200}`)) {
+		t.Errorf("got %q", buf[:n])
+	}
+	// audit records of hijacked tunnels can arrive after shutdown closed the writer
+	w.send([]byte(`{"status":200}`))
+}
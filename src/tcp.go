@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+// tcpOptions are the socket options of domain.TCPOptions in a comparable form, so that they can be part of a transportKey.
+type tcpOptions struct {
+	noDelay     bool
+	readBuffer  int
+	writeBuffer int
+}
+
+func newTCPOptions(o domain.TCPOptions) tcpOptions {
+	return tcpOptions{noDelay: *o.NoDelay, readBuffer: o.ReadBuffer, writeBuffer: o.WriteBuffer}
+}
+
+// apply sets the options on the TCP connection underlying c. Other connections are left as they are.
+// Failing to set an option does not make the connection unusable, so errors are ignored.
+func (o tcpOptions) apply(c net.Conn) {
+	tc, ok := tcpConnOf(c)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(o.noDelay)
+	if o.readBuffer > 0 {
+		tc.SetReadBuffer(o.readBuffer)
+	}
+	if o.writeBuffer > 0 {
+		tc.SetWriteBuffer(o.writeBuffer)
+	}
+}
+
+// dialer wraps dial so that the options are set on every connection it returns.
+func (o tcpOptions) dialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err == nil {
+			o.apply(c)
+		}
+		return c, err
+	}
+}
+
+// tcpConnOf unwraps the connections of this package and those exposing NetConn, like *tls.Conn.
+func tcpConnOf(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn, true
+		case *inboundConn:
+			c = conn.Conn
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
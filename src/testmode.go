@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// stubUpstream is what the stub answers with: the route the request took and the request as the upstream received it.
+type stubUpstream struct {
+	TestMode    bool   `json:"test_mode"`
+	Rule        string `json:"rule,omitempty"`
+	ProxyType   string `json:"proxy_type"`
+	ProxyAddr   string `json:"proxy_addr,omitempty"`
+	SourceIP    string `json:"source_ip,omitempty"`
+	Destination string `json:"destination"`
+
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Host      string      `json:"host"`
+	Header    http.Header `json:"header"`
+	BodyBytes int64       `json:"body_bytes"`
+	TLS       bool        `json:"tls"` // the client spoke TLS through a CONNECT tunnel
+}
+
+// stubDialer returns a dialer that never touches the network, for --test-mode. Every connection is answered in process
+// by serveStub, which echoes the route described by key and the request it received.
+func stubDialer(key transportKey) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		info := stubUpstream{TestMode: true, ProxyType: key.proxyType, ProxyAddr: key.proxyAddr, SourceIP: key.sourceIP, Destination: addr}
+		if e, ok := inflightFrom(ctx); ok {
+			info.Rule = *e.rule.Load()
+		}
+		client, server := net.Pipe()
+		go serveStub(server, info)
+		return client, nil
+	}
+}
+
+// serveStub answers HTTP/1.1 requests on conn until the client closes it. Clients tunneling TLS
+// get a self-signed certificate, so they must skip verification.
+func serveStub(conn net.Conn, info stubUpstream) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	if b, err := br.Peek(1); err == nil && b[0] == 0x16 { // TLS handshake record
+		cert, err := stubCertificate()
+		if err != nil {
+			return
+		}
+		tc := tls.Server(bufferedConn{Conn: conn, r: br}, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}})
+		conn, br, info.TLS = tc, bufio.NewReader(tc), true
+	}
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		echo := info
+		echo.Method, echo.URL, echo.Host, echo.Header = req.Method, req.RequestURI, req.Host, req.Header
+		echo.BodyBytes, _ = io.Copy(io.Discard, req.Body)
+		body, _ := json.MarshalIndent(echo, "", "  ")
+		res := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			ContentLength: int64(len(body)),
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			Close:         req.Close,
+		}
+		if res.Write(conn) != nil || req.Close {
+			return
+		}
+	}
+}
+
+// bufferedConn reads through r, which has buffered the start of Conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// stubCertificate is the self-signed certificate of serveStub, generated on first use.
+var stubCertificate = sync.OnceValues(func() (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "h2s-proxy test mode"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+})
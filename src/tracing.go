@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/shirobrak/h2s-proxy"
+
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// newTracerProvider returns a provider exporting spans over OTLP/HTTP,
+// or a no-op provider when no endpoint is configured. The returned function flushes and stops the exporter.
+func newTracerProvider(cfg domain.Tracing, userAgent string) (trace.TracerProvider, func(context.Context) error, error) {
+	if cfg.OTLPEndpoint == "" {
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(cfg.OTLPEndpoint),
+		otlptracehttp.WithHeaders(map[string]string{"User-Agent": userAgent}),
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", cfg.ServiceName),
+			attribute.String("service.version", version),
+		)),
+	)
+	return tp, tp.Shutdown, nil
+}
+
+// startSpan starts the server span of req, continuing the trace sent by the client if any.
+func (s *H2SProxyServer) startSpan(req *http.Request) (context.Context, trace.Span) {
+	ctx := tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	return s.tracer.Start(ctx, req.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.String()),
+			attribute.String("client.address", clientIP(req)),
+		))
+}
+
+// setSpanRoute records the route chosen for the request traced in ctx.
+func setSpanRoute(ctx context.Context, rule *domain.Rule, endpoint domain.Endpoint) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("h2s.rule", routeName(rule)))
+	if endpoint.ProxyIP != "" {
+		span.SetAttributes(attribute.String("h2s.endpoint", endpoint.Addr()))
+	}
+}
+
+func endSpan(span trace.Span, status int) {
+	if status != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+	}
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+	"golang.org/x/net/proxy"
+)
+
+// drainPollInterval is how often a retired transport is checked for requests still using it.
+const drainPollInterval = time.Second
+
+// transportKey identifies the upstream settings a transport is built from.
+// Rules with identical settings share one transport and its connection pool.
+type transportKey struct {
+	proxyType string
+	proxyAddr string
+	username  string
+	password  domain.Secret
+	http1     bool
+	grpc      bool // HTTP/2 only, over h2c for http:// destinations
+	sourceIP  string
+	network   string // of the connection to the SOCKS server
+	tcp       tcpOptions
+	dns       string // dns_servers joined by ","
+
+	responseHeaderTimeout time.Duration
+	blockPrivate          bool // direct connections to private addresses are refused, see refusePrivateDial
+
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	idleConnTimeout     time.Duration
+	maxConnLifetime     time.Duration
+}
+
+// newTransportKey describes the upstream for rule and, for SOCKS rules, the chosen endpoint.
+func newTransportKey(profile *domain.Profile, rule *domain.Rule, endpoint domain.Endpoint) transportKey {
+	key := transportKey{
+		proxyType:             domain.ProxyTypeDirect,
+		http1:                 profile.HTTP1Only(rule),
+		tcp:                   newTCPOptions(profile.TCP),
+		dns:                   strings.Join(profile.DNSServers, ","),
+		responseHeaderTimeout: profile.ResponseHeaderTimeoutFor(rule),
+	}
+	key.blockPrivate = blocksPrivateNetworks(profile, rule)
+	pool := profile.Pool
+	if rule != nil {
+		pool = rule.Pool
+		key.proxyType = rule.ProxyType
+		key.sourceIP = rule.SourceIP
+		if rule.ProxyType == domain.ProxyTypeSOCKS5 {
+			key.proxyAddr = endpoint.Addr()
+			key.network = rule.Network
+			key.username = rule.Username
+			key.password = rule.Password
+		}
+	}
+	key.maxIdleConns = *pool.MaxIdleConns
+	key.maxIdleConnsPerHost = *pool.MaxIdleConnsPerHost
+	key.maxConnsPerHost = *pool.MaxConnsPerHost
+	key.idleConnTimeout = time.Duration(*pool.IdleConnTimeout)
+	key.maxConnLifetime = time.Duration(*pool.MaxConnLifetime)
+	return key
+}
+
+// transportKeys returns the keys of every upstream profile can route to.
+func transportKeys(profile *domain.Profile) map[transportKey]bool {
+	keys := map[transportKey]bool{}
+	add := func(key transportKey) {
+		keys[key] = true
+		key.grpc = true
+		keys[key] = true
+	}
+	add(newTransportKey(profile, nil, domain.Endpoint{}))
+	for i := range profile.Rules {
+		rule := &profile.Rules[i]
+		if rule.ProxyType != domain.ProxyTypeSOCKS5 {
+			add(newTransportKey(profile, rule, domain.Endpoint{}))
+			continue
+		}
+		for _, ep := range rule.Endpoints {
+			add(newTransportKey(profile, rule, ep))
+		}
+	}
+	return keys
+}
+
+// cachedTransport counts the requests using a transport, so it can be closed once they are done.
+type cachedTransport struct {
+	*http.Transport
+	active  atomic.Int64
+	created time.Time
+
+	requests atomic.Int64 // acquired since the last idle sweep
+	closed   atomic.Int64 // upstream connections closed, see countClosed
+}
+
+// transportCache keeps transports alive across requests so upstream connections are reused.
+type transportCache struct {
+	mu         sync.Mutex
+	transports map[transportKey]*cachedTransport
+	spares     *sparePool
+	stub       bool // --test-mode: dial stubDialer instead of the upstreams
+}
+
+func newTransportCache() *transportCache {
+	return &transportCache{transports: make(map[transportKey]*cachedTransport), spares: newSparePool()}
+}
+
+// acquire returns the transport for key, creating it if needed.
+// A transport older than key.maxConnLifetime is replaced by a new one and returned as expired, for the caller to drain.
+// The caller must call release once the response has been consumed.
+func (c *transportCache) acquire(key transportKey, now time.Time) (tr *http.Transport, release func(), expired *cachedTransport, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ct, ok := c.transports[key]
+	if ok && key.maxConnLifetime > 0 && now.Sub(ct.created) >= key.maxConnLifetime {
+		expired, ok = ct, false
+	}
+	if !ok {
+		dial, err := c.dialer(key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ct = &cachedTransport{created: now}
+		dial = countClosed(dial, &ct.closed)
+		ct.Transport = newTransport(key, dial)
+		if c.stub {
+			// the stub speaks HTTP/1.1 in clear on every connection, and reports the request it served on
+			ct.DialTLSContext = dial
+			ct.DisableKeepAlives = true
+		}
+		c.transports[key] = ct
+	}
+	ct.active.Add(1)
+	ct.requests.Add(1)
+	return ct.Transport, func() { ct.active.Add(-1) }, expired, nil
+}
+
+// retain removes the transports whose key is not in keys and returns them.
+func (c *transportCache) retain(keys map[transportKey]bool) map[transportKey]*cachedTransport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	retired := make(map[transportKey]*cachedTransport)
+	for key, ct := range c.transports {
+		if !keys[key] {
+			retired[key] = ct
+			delete(c.transports, key)
+		}
+	}
+	return retired
+}
+
+// drainTransports retires the transports the profile no longer routes to. Requests still using one
+// finish normally; its connections are closed once they are done, instead of lingering in the pool.
+func (s *H2SProxyServer) drainTransports(profile *domain.Profile) {
+	for key, ct := range s.transports.retain(transportKeys(profile)) {
+		s.logger.Infow("draining transport", "proxyType", key.proxyType, "proxyAddr", key.proxyAddr, "active", ct.active.Load())
+		s.drainTransport(ct, func() {
+			s.logger.Infow("transport drained", "proxyType", key.proxyType, "proxyAddr", key.proxyAddr)
+		})
+	}
+}
+
+// drainTransport closes the connections of ct once no request uses it anymore, then calls done.
+func (s *H2SProxyServer) drainTransport(ct *cachedTransport, done func()) {
+	ct.CloseIdleConnections()
+	go func() {
+		for ct.active.Load() > 0 {
+			<-s.clock.After(drainPollInterval)
+		}
+		ct.CloseIdleConnections()
+		done()
+	}()
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// baseDialer returns the dialer for TCP connections originating from sourceIP, or any local address when empty,
+// resolving names with the dns servers, see dnsResolver.
+func baseDialer(sourceIP, dns string) *net.Dialer {
+	// same settings as the dialer of http.DefaultTransport
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if dns != "" {
+		dialer.Resolver = dnsResolver(dns)
+	}
+	if sourceIP != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(sourceIP)}
+	}
+	return dialer
+}
+
+// dialer returns the function connecting to destinations through the upstream described by key.
+func (c *transportCache) dialer(key transportKey) (dialFunc, error) {
+	if c.stub {
+		return stubDialer(key), nil
+	}
+	return newDialer(key, c.spares)
+}
+
+// newDialer returns the function connecting to destinations through the upstream described by key.
+// SOCKS connections start from a spare connection to the SOCKS server when warm-up provided one.
+func newDialer(key transportKey, spares *sparePool) (dialFunc, error) {
+	dialer := baseDialer(key.sourceIP, key.dns)
+	if key.proxyType != domain.ProxyTypeSOCKS5 {
+		if key.blockPrivate {
+			dialer.Control = refusePrivateDial
+		}
+		return key.tcp.dialer(dialer.DialContext), nil
+	}
+	var auth *proxy.Auth
+	if key.username != "" {
+		auth = &proxy.Auth{User: key.username, Password: string(key.password)}
+	}
+	// source_ip applies to the connection to the SOCKS server
+	forward := socksServerDialer{spareDialer{
+		Dialer: dialer,
+		key:    spareKey{proxyAddr: key.proxyAddr, sourceIP: key.sourceIP, network: key.network},
+		spares: spares,
+		tcp:    key.tcp,
+	}}
+	socksDialer, err := proxy.SOCKS5(key.network, key.proxyAddr, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	return classifySOCKS(socksDialer.(proxy.ContextDialer).DialContext), nil
+}
+
+func newTransport(key transportKey, dial dialFunc) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = dial
+	tr.MaxIdleConns = key.maxIdleConns
+	tr.MaxIdleConnsPerHost = key.maxIdleConnsPerHost
+	tr.MaxConnsPerHost = key.maxConnsPerHost
+	tr.IdleConnTimeout = key.idleConnTimeout
+	tr.ResponseHeaderTimeout = key.responseHeaderTimeout
+	if key.proxyType == domain.ProxyTypeSOCKS5 {
+		tr.Proxy = nil
+		// SOCKS routes have always spoken HTTP/1.1 to the origin
+		tr.ForceAttemptHTTP2 = false
+	}
+	switch {
+	case key.grpc:
+		// gRPC cannot fall back to HTTP/1.1, so force_http1 does not apply
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetHTTP2(true)
+		tr.Protocols.SetUnencryptedHTTP2(true)
+	case key.http1:
+		disableHTTP2(tr)
+	}
+	return tr
+}
+
+// pickEndpoint selects the SOCKS endpoint for a request matched by rule. Direct routes have none.
+func (s *H2SProxyServer) pickEndpoint(rule *domain.Rule) domain.Endpoint {
+	if rule == nil || rule.ProxyType != domain.ProxyTypeSOCKS5 {
+		return domain.Endpoint{}
+	}
+	ep := rule.NextEndpoint()
+	s.metrics.endpointRequests.inc(rule.Name, ep.Addr())
+	return ep
+}
+
+// disableHTTP2 keeps the transport on HTTP/1.1 even when the origin offers h2 via ALPN.
+func disableHTTP2(tr *http.Transport) {
+	tr.ForceAttemptHTTP2 = false
+	tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+}
+
+// traceConnReuse records whether the upstream connection for the request was reused from the pool.
+func (s *H2SProxyServer) traceConnReuse(ctx context.Context, rule string) context.Context {
+	if !s.metrics.enabled() {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.metrics.upstreamConns.inc(rule, strconv.FormatBool(info.Reused))
+		},
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+const sniPeekTimeout = 5 * time.Second
+
+var connectEstablished = []byte("HTTP/1.1 200 Connection Established\r\n\r\n")
+
+// connectHandler tunnels a CONNECT request to its target through the matched rule.
+//
+// With peek_sni enabled the client is told the tunnel is up before a rule is chosen,
+// so that it sends its TLS ClientHello. The ClientHello is read without terminating TLS,
+// its SNI is used for matching, and the bytes read are replayed to the upstream.
+func (s *H2SProxyServer) connectHandler(wr http.ResponseWriter, req *http.Request, profile *domain.Profile, inbound *inboundRequest, user string, claims map[string][]string) {
+	dest, err := parseDestination(req.Host, "")
+	if err != nil {
+		s.logger.Warnw("invalid CONNECT target", "host", req.Host, "error", err)
+		http.Error(wr, "invalid CONNECT target", http.StatusBadRequest)
+		return
+	}
+	req.Host = dest.authority()
+	host, port := dest.host, dest.port
+	if profile.PortBlocked(port) {
+		s.deny(wr, profile, req.Host, "blocked port")
+		return
+	}
+	if !profile.ConnectPortAllowed(port) {
+		s.deny(wr, profile, req.Host, "CONNECT port not allowed")
+		return
+	}
+	hj, ok := wr.(http.Hijacker)
+	if !ok {
+		s.logger.Error("CONNECT is not supported on this connection")
+		http.Error(wr, "unexpected error", http.StatusInternalServerError)
+		return
+	}
+	target := domain.Target{Host: host, Port: portNumber(port), Header: req.Header, User: user, Claims: claims, Time: inbound.start}
+
+	if !profile.PeekSNI {
+		matched, pattern, err := s.matchRoute(req.Context(), profile, &target)
+		if errors.Is(err, errNoHealthyRule) {
+			s.logger.Warnw("no healthy rule", "target", req.Host)
+			http.Error(wr, "no healthy upstream for "+req.Host, http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			s.logger.Errorf("failed to match rule: %v", err)
+			http.Error(wr, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		inbound.setRule(routeName(matched))
+		if reason := denyReason(profile, matched); reason != "" {
+			s.deny(wr, profile, req.Host, reason, "rule", routeName(matched))
+			return
+		}
+		if addr, reason := s.privateDestination(req.Context(), profile, matched, &target); reason != "" {
+			s.deny(wr, profile, req.Host, reason, "rule", routeName(matched), "address", addr)
+			return
+		}
+		if s.maintenance.covers(routeName(matched)) {
+			s.refuseForMaintenance(wr, req, profile, req.Host, routeName(matched))
+			return
+		}
+		upstream, err := s.dialTunnel(req.Context(), profile, matched, pattern, req.Host)
+		if err != nil {
+			http.Error(wr, "failed to connect to "+req.Host+s.socksDetail(err)+errorDetail(profile, err), upstreamStatus(err))
+			return
+		}
+		conn, brw, err := hj.Hijack()
+		if err != nil {
+			upstream.Close()
+			s.logger.Errorf("failed to hijack connection: %v", err)
+			return
+		}
+		newTCPOptions(profile.TCP).apply(conn)
+		if _, err := conn.Write(connectEstablished); err != nil {
+			conn.Close()
+			upstream.Close()
+			return
+		}
+		inbound.tunnelIn, inbound.tunnelOut = s.tunnel(req.Context(), conn, brw.Reader, upstream, profile.CopyBufferSize)
+		return
+	}
+
+	if s.maintenance.all() {
+		// rule-scoped maintenance can only be told once the ClientHello is read, after the 200
+		s.refuseForMaintenance(wr, req, profile, req.Host, ruleLabelNone)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		s.logger.Errorf("failed to hijack connection: %v", err)
+		return
+	}
+	newTCPOptions(profile.TCP).apply(conn)
+	if _, err := conn.Write(connectEstablished); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+	serverName, replay, err := peekServerName(brw.Reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		s.loggerFor(req.Context(), nil).Debugf("no TLS ClientHello on tunnel to %v: %v", req.Host, err)
+	}
+	target.ServerName = serverName
+	matched, pattern, err := s.matchRoute(req.Context(), profile, &target)
+	if errors.Is(err, errNoHealthyRule) {
+		s.logger.Warnw("no healthy rule", "target", req.Host, "serverName", serverName)
+		conn.Close()
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("failed to match rule: %v", err)
+		conn.Close()
+		return
+	}
+	inbound.setRule(routeName(matched))
+	if reason := denyReason(profile, matched); reason != "" {
+		s.logDenied(req.Host, reason, "rule", routeName(matched), "serverName", serverName)
+		conn.Close()
+		return
+	}
+	if addr, reason := s.privateDestination(req.Context(), profile, matched, &target); reason != "" {
+		s.logDenied(req.Host, reason, "rule", routeName(matched), "serverName", serverName, "address", addr)
+		conn.Close()
+		return
+	}
+	if s.maintenance.covers(routeName(matched)) {
+		s.loggerFor(req.Context(), matched).Debugw("tunnel closed for maintenance", "destination", req.Host, "rule", routeName(matched), "serverName", serverName)
+		conn.Close()
+		return
+	}
+	// the client already got 200, so failures can only be reported by closing the tunnel
+	upstream, err := s.dialTunnel(req.Context(), profile, matched, pattern, req.Host)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	inbound.tunnelIn, inbound.tunnelOut = s.tunnel(req.Context(), conn, replay, upstream, profile.CopyBufferSize)
+}
+
+func (s *H2SProxyServer) dialTunnel(ctx context.Context, profile *domain.Profile, rule *domain.Rule, pattern, addr string) (net.Conn, error) {
+	endpoint := s.pickEndpoint(rule)
+	setSpanRoute(ctx, rule, endpoint)
+	log := s.loggerFor(ctx, rule)
+	if rule != nil {
+		log.Infow("tunnel", "rule", rule.Name, "pattern", pattern, "target", addr, "proxyType", rule.ProxyType, "proxyIP", endpoint.ProxyIP, "proxyPort", endpoint.Port)
+	} else {
+		log.Infow("tunnel", "rule", defaultRuleName, "target", addr)
+	}
+	release, err := s.acquireSlot(ctx, rule)
+	if err != nil {
+		log.Warnw("tunnel refused", "rule", routeName(rule), "target", addr, "error", err)
+		return nil, err
+	}
+	dial, err := s.transports.dialer(newTransportKey(profile, rule, endpoint))
+	if err == nil {
+		var conn net.Conn
+		conn, err = dial(ctx, "tcp", addr)
+		s.recordUpstream(ctx, profile, rule, err)
+		if err == nil {
+			return slotConn{Conn: conn, release: release}, nil
+		}
+	}
+	release()
+	if !s.reportSOCKSError(log, routeName(rule), addr, err) {
+		log.Errorf("failed to connect to %v: %v", addr, err)
+	}
+	return nil, err
+}
+
+// tunnel copies bytes in both directions through pooled buffers of bufSize until both sides are done, then closes both connections.
+// clientReader must read from client, including anything net/http already buffered.
+// It returns the bytes copied from and to the client. Canceling ctx closes both connections.
+func (s *H2SProxyServer) tunnel(ctx context.Context, client net.Conn, clientReader io.Reader, upstream net.Conn, bufSize int) (in, out int64) {
+	defer client.Close()
+	defer upstream.Close()
+	stop := context.AfterFunc(ctx, func() {
+		client.Close()
+		upstream.Close()
+	})
+	defer stop()
+	done := make(chan struct{}, 2)
+	go func() {
+		in, _ = s.copyBuffers.copy(upstream, clientReader, bufSize)
+		closeWrite(upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		out, _ = s.copyBuffers.copy(client, upstream, bufSize)
+		closeWrite(client)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	return in, out
+}
+
+// closeWrite half-closes conn when supported so the peer sees EOF while the other direction keeps flowing.
+// Connections without half-close support are closed entirely.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestConnectTunnel(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 100<<10) // several buffers each way
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(w, req.Body)
+	}))
+	defer upstream.Close()
+	_, proxy := newTestProxy(t, `{"version": 2, "listen_addrs": ["127.0.0.1:0"], "copy_buffer_size": 4096}`)
+	proxyURL, _ := url.Parse(proxy.URL)
+	tr := upstream.Client().Transport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyURL(proxyURL)
+	client := &http.Client{Transport: tr}
+	defer client.CloseIdleConnections()
+
+	res, err := client.Post(upstream.URL, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("got %v bytes (%v), want the %v bytes sent echoed back", len(got), err, len(body))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirobrak/h2s-proxy/domain"
+)
+
+// spareKey identifies connections to one SOCKS server from one local address over one network.
+type spareKey struct {
+	proxyAddr string
+	sourceIP  string
+	network   string
+}
+
+type spareConn struct {
+	net.Conn
+	dialed time.Time
+}
+
+// sparePool holds TCP connections dialed to SOCKS servers ahead of time. Pooled HTTP connections
+// go to a specific destination, so they cannot be opened before a request; the connection to the
+// SOCKS server can, saving its round trips on the first request of a cold rule.
+type sparePool struct {
+	mu     sync.Mutex
+	conns  map[spareKey][]spareConn
+	maxAge time.Duration // spares dialed longer ago are not used
+}
+
+func newSparePool() *sparePool {
+	return &sparePool{conns: make(map[spareKey][]spareConn)}
+}
+
+// take returns a fresh spare connection for key, if any.
+func (p *sparePool) take(key spareKey) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	notBefore := time.Now().Add(-p.maxAge)
+	for conns := p.conns[key]; len(conns) > 0; conns = p.conns[key] {
+		c := conns[len(conns)-1]
+		p.conns[key] = conns[:len(conns)-1]
+		if c.dialed.After(notBefore) {
+			return c.Conn
+		}
+		c.Close()
+	}
+	return nil
+}
+
+func (p *sparePool) put(key spareKey, c spareConn) {
+	p.mu.Lock()
+	p.conns[key] = append(p.conns[key], c)
+	p.mu.Unlock()
+}
+
+// prune closes spares older than maxAge or for servers no longer in keys,
+// and returns how many are left for each key.
+func (p *sparePool) prune(keys map[spareKey]bool, maxAge time.Duration) map[spareKey]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxAge = maxAge
+	notBefore := time.Now().Add(-maxAge)
+	left := make(map[spareKey]int)
+	for key, conns := range p.conns {
+		kept := conns[:0]
+		for _, c := range conns {
+			if keys[key] && c.dialed.After(notBefore) {
+				kept = append(kept, c)
+			} else {
+				c.Close()
+			}
+		}
+		p.conns[key] = kept
+		left[key] = len(kept)
+	}
+	return left
+}
+
+// spareDialer dials the SOCKS server, using a spare connection when one is available.
+type spareDialer struct {
+	*net.Dialer
+	key    spareKey
+	spares *sparePool
+	tcp    tcpOptions
+}
+
+func (d spareDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c := d.spares.take(d.key); c != nil {
+		d.tcp.apply(c)
+		return c, nil
+	}
+	return d.tcp.dialer(d.Dialer.DialContext)(ctx, network, addr)
+}
+
+func (d spareDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// warmup keeps warmup.connections spare connections to every SOCKS endpoint until ctx is done.
+// Spares older than the interval are replaced, since SOCKS servers may drop idle connections.
+func (s *H2SProxyServer) warmup(ctx context.Context) {
+	for {
+		profile := s.profile.Load()
+		w := profile.Warmup
+		interval := time.Duration(w.Interval)
+		if w.Connections > 0 {
+			s.warmupRound(ctx, profile, interval)
+		} else {
+			s.transports.spares.prune(nil, 0)
+		}
+		select {
+		case <-ctx.Done():
+			s.transports.spares.prune(nil, 0)
+			return
+		case <-s.clock.After(interval):
+		}
+	}
+}
+
+func (s *H2SProxyServer) warmupRound(ctx context.Context, profile *domain.Profile, interval time.Duration) {
+	keys := make(map[spareKey]bool)
+	for i := range profile.Rules {
+		rule := &profile.Rules[i]
+		for _, ep := range rule.Endpoints {
+			keys[spareKey{proxyAddr: ep.Addr(), sourceIP: rule.SourceIP, network: rule.Network}] = true
+		}
+	}
+	left := s.transports.spares.prune(keys, interval)
+
+	sem := make(chan struct{}, profile.Warmup.Concurrency)
+	var wg sync.WaitGroup
+	for key := range keys {
+		for n := left[key]; n < profile.Warmup.Connections; n++ {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				conn, err := baseDialer(key.sourceIP, strings.Join(profile.DNSServers, ",")).DialContext(ctx, key.network, key.proxyAddr)
+				if err != nil {
+					s.logger.Warnw("warm-up failed", "proxyAddr", key.proxyAddr, "error", err)
+					return
+				}
+				s.transports.spares.put(key, spareConn{Conn: conn, dialed: time.Now()})
+			}()
+		}
+	}
+	wg.Wait()
+}